@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"math"
+)
+
+// QueryAdapter runs queries against a backend that isn't reachable through a
+// database/sql driver, such as a database with an HTTP API. Its results are
+// fed through the same value and label handling as SQL rows.
+type QueryAdapter interface {
+	// Query runs query with args bound to its placeholders
+	Query(ctx context.Context, query string, args []interface{}) (*QueryResult, error)
+	// Ping checks the backend is reachable
+	Ping(ctx context.Context) error
+}
+
+// QueryResult is a columnar result set returned by a QueryAdapter. Values
+// are as decoded from JSON: numbers, strings, booleans or nil.
+type QueryResult struct {
+	Columns []string        `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+// queryAdapters creates the adapter for each driver name that selects one
+var queryAdapters = map[string]func(cfg DatabaseConfig) (QueryAdapter, error){
+	mockDriverName: newMockAdapter,
+	httpDriverName: newHTTPAdapter,
+}
+
+// adapterConnector is a driver.Connector running queries through an adapter,
+// so adapters get connection pooling and everything else database/sql offers
+type adapterConnector struct {
+	adapter QueryAdapter
+}
+
+// Connect implements driver.Connector
+func (c *adapterConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return &adapterConn{adapter: c.adapter}, nil
+}
+
+// Driver implements driver.Connector
+func (c *adapterConnector) Driver() driver.Driver {
+	return adapterDriver{}
+}
+
+// adapterDriver is the driver.Driver behind adapter connectors
+type adapterDriver struct{}
+
+// Open implements driver.Driver. Adapters are only usable through their
+// connector since they are configured by more than a DSN.
+func (adapterDriver) Open(name string) (driver.Conn, error) {
+	return nil, errors.New("adapter: driver must be opened through its connector")
+}
+
+// adapterConn is a connection to an adapter
+type adapterConn struct {
+	adapter QueryAdapter
+}
+
+// Prepare implements driver.Conn
+func (c *adapterConn) Prepare(query string) (driver.Stmt, error) {
+	return &adapterStmt{conn: c, query: query}, nil
+}
+
+// Close implements driver.Conn
+func (c *adapterConn) Close() error {
+	return nil
+}
+
+// Begin implements driver.Conn
+func (c *adapterConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("adapter: transactions are not supported")
+}
+
+// QueryContext implements driver.QueryerContext
+func (c *adapterConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	values := make([]interface{}, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	return c.query(ctx, query, values)
+}
+
+// Ping implements driver.Pinger
+func (c *adapterConn) Ping(ctx context.Context) error {
+	return c.adapter.Ping(ctx)
+}
+
+// query runs a query through the adapter
+func (c *adapterConn) query(ctx context.Context, query string, args []interface{}) (driver.Rows, error) {
+	result, err := c.adapter.Query(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &adapterRows{result: result}, nil
+}
+
+// adapterStmt is a prepared statement on an adapter
+type adapterStmt struct {
+	conn  *adapterConn
+	query string
+}
+
+// Close implements driver.Stmt
+func (s *adapterStmt) Close() error {
+	return nil
+}
+
+// NumInput implements driver.Stmt
+func (s *adapterStmt) NumInput() int {
+	return -1
+}
+
+// Exec implements driver.Stmt
+func (s *adapterStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("adapter: exec is not supported")
+}
+
+// Query implements driver.Stmt
+func (s *adapterStmt) Query(args []driver.Value) (driver.Rows, error) {
+	values := make([]interface{}, len(args))
+	for i, arg := range args {
+		values[i] = arg
+	}
+	return s.conn.query(context.Background(), s.query, values)
+}
+
+// adapterRows iterates over an adapter's result set
+type adapterRows struct {
+	result *QueryResult
+	pos    int
+}
+
+// Columns implements driver.Rows
+func (r *adapterRows) Columns() []string {
+	return r.result.Columns
+}
+
+// Close implements driver.Rows
+func (r *adapterRows) Close() error {
+	return nil
+}
+
+// Next implements driver.Rows
+func (r *adapterRows) Next(dest []driver.Value) error {
+	if r.pos >= len(r.result.Rows) {
+		return io.EOF
+	}
+
+	row := r.result.Rows[r.pos]
+	r.pos++
+	for i := range dest {
+		if i < len(row) {
+			dest[i] = driverValue(row[i])
+		} else {
+			dest[i] = nil
+		}
+	}
+	return nil
+}
+
+// driverValue converts a JSON-decoded value to the type a SQL driver would
+// return: whole numbers become int64 and strings come back as raw bytes
+func driverValue(value interface{}) driver.Value {
+	switch v := value.(type) {
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return int64(v)
+		}
+		return v
+	case string:
+		return []byte(v)
+	default:
+		return v
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ServerConfig holds the configuration of the HTTP server
+type ServerConfig struct {
+	// BasicAuth and BearerToken protect the metrics endpoints. A request
+	// needs either credential when both are set. The endpoints are open when
+	// neither is set.
+	BasicAuth   *BasicAuthConfig `json:"basic_auth"`
+	BearerToken string           `json:"bearer_token"`
+
+	TLS ServerTLSConfig `json:"tls"`
+}
+
+// BasicAuthConfig holds the HTTP basic auth credentials of the metrics
+// endpoints
+type BasicAuthConfig struct {
+	Username string `json:"username"`
+	// PasswordHash is the bcrypt hash of the password, so the config
+	// doesn't hold it in the clear
+	PasswordHash string `json:"password_hash"`
+}
+
+// authRequired reports whether the metrics endpoints need credentials
+func (c ServerConfig) authRequired() bool {
+	return c.BasicAuth != nil || c.BearerToken != ""
+}
+
+// requireAuth wraps a metrics endpoint's handler, responding with 401 to
+// requests without valid credentials
+func (a *App) requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.config.Server.authRequired() || a.authenticated(r) {
+			next(w, r)
+			return
+		}
+
+		if a.config.Server.BasicAuth != nil {
+			w.Header().Add("WWW-Authenticate", `Basic realm="custom-sql-metrics"`)
+		}
+		if a.config.Server.BearerToken != "" {
+			w.Header().Add("WWW-Authenticate", "Bearer")
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	}
+}
+
+// authenticated reports whether the request carries a configured credential
+func (a *App) authenticated(r *http.Request) bool {
+	server := a.config.Server
+
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && server.BearerToken != "" {
+		return subtle.ConstantTimeCompare([]byte(token), []byte(server.BearerToken)) == 1
+	}
+
+	if username, password, ok := r.BasicAuth(); ok && server.BasicAuth != nil {
+		// Compare the password even for a wrong username, so timing doesn't
+		// reveal valid usernames
+		validUser := subtle.ConstantTimeCompare([]byte(username), []byte(server.BasicAuth.Username)) == 1
+		validPassword := bcrypt.CompareHashAndPassword([]byte(server.BasicAuth.PasswordHash), []byte(password)) == nil
+		return validUser && validPassword
+	}
+	return false
+}
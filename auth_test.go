@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestRequireAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := newTestApp(t, fmt.Sprintf(`{
+		"server": {"basic_auth": {"username": "prometheus", "password_hash": %q}, "bearer_token": "secret"},
+		"database": {"driver": "mock", "mock": [{"query": "SELECT 1 AS value", "columns": ["value"], "rows": [[1]]}]},
+		"metrics": [{"name": "up", "query": "SELECT 1 AS value"}]
+	}`, hash))
+
+	tests := []struct {
+		name     string
+		target   string
+		setAuth  func(r *http.Request)
+		wantCode int
+	}{
+		{name: "no credentials", target: "/metrics", wantCode: http.StatusUnauthorized},
+		{name: "basic auth", target: "/metrics", setAuth: func(r *http.Request) { r.SetBasicAuth("prometheus", "hunter2") }, wantCode: http.StatusOK},
+		{name: "wrong password", target: "/metrics", setAuth: func(r *http.Request) { r.SetBasicAuth("prometheus", "hunter3") }, wantCode: http.StatusUnauthorized},
+		{name: "wrong username", target: "/metrics", setAuth: func(r *http.Request) { r.SetBasicAuth("admin", "hunter2") }, wantCode: http.StatusUnauthorized},
+		{name: "bearer token", target: "/metrics", setAuth: func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") }, wantCode: http.StatusOK},
+		{name: "wrong bearer token", target: "/metrics", setAuth: func(r *http.Request) { r.Header.Set("Authorization", "Bearer guess") }, wantCode: http.StatusUnauthorized},
+		{name: "JSON without credentials", target: "/metrics.json", wantCode: http.StatusUnauthorized},
+		{name: "JSON with bearer token", target: "/metrics.json", setAuth: func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") }, wantCode: http.StatusOK},
+		{name: "probe without credentials", target: "/probe", wantCode: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.setAuth != nil {
+				tt.setAuth(req)
+			}
+			rec := httptest.NewRecorder()
+			app.routes().ServeHTTP(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Errorf("GET %s status = %d, want %d", tt.target, rec.Code, tt.wantCode)
+			}
+			if tt.wantCode == http.StatusUnauthorized && len(rec.Header().Values("WWW-Authenticate")) != 2 {
+				t.Errorf("WWW-Authenticate = %q, want both schemes offered", rec.Header().Values("WWW-Authenticate"))
+			}
+		})
+	}
+
+	// Orchestrators' probes don't carry the credentials
+	for _, target := range []string{"/health", "/ready"} {
+		rec := httptest.NewRecorder()
+		app.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code == http.StatusUnauthorized {
+			t.Errorf("GET %s without credentials status = %d, want it open", target, rec.Code)
+		}
+	}
+}
+
+func TestNoAuthConfigured(t *testing.T) {
+	app := newTestApp(t, `{
+		"database": {"driver": "mock", "mock": [{"query": "SELECT 1 AS value", "columns": ["value"], "rows": [[1]]}]},
+		"metrics": [{"name": "up", "query": "SELECT 1 AS value"}]
+	}`)
+	wantLines(t, scrape(t, app, "/metrics"), "up 1")
+}
+
+func TestBasicAuthConfigErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   string
+	}{
+		{
+			name:   "missing username",
+			config: `{"database": {"driver": "mock"}, "server": {"basic_auth": {"password_hash": "$2y$10$abc"}}}`,
+			want:   "server.basic_auth needs a username and a password_hash",
+		},
+		{
+			name:   "plaintext password",
+			config: `{"database": {"driver": "mock"}, "server": {"basic_auth": {"username": "prometheus", "password_hash": "hunter2"}}}`,
+			want:   "server.basic_auth.password_hash isn't a bcrypt hash",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseConfig(strings.NewReader(tt.config), "test config", configFormatJSON, false)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("parseConfig() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
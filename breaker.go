@@ -0,0 +1,103 @@
+package main
+
+import (
+	"sync"
+)
+
+// breakerState is the state of a metric's circuit breaker
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+// circuitBreaker stops collecting a metric after a number of consecutive
+// failures. While open, collection is skipped for an exponentially growing
+// number of intervals, after which a single probe is allowed through.
+type circuitBreaker struct {
+	threshold int
+	maxSkip   int
+
+	mu        sync.Mutex
+	state     breakerState
+	failures  int
+	skip      int
+	remaining int
+}
+
+// newCircuitBreaker creates a circuit breaker that opens after threshold
+// consecutive failures and skips at most maxSkip intervals between probes.
+// A threshold of zero disables the breaker.
+func newCircuitBreaker(threshold, maxSkip int) *circuitBreaker {
+	if maxSkip < 1 {
+		maxSkip = 1
+	}
+	return &circuitBreaker{threshold: threshold, maxSkip: maxSkip}
+}
+
+// Allow reports whether the next collection may run
+func (b *circuitBreaker) Allow() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerOpen {
+		if b.remaining > 0 {
+			b.remaining--
+			return false
+		}
+		// Let a single probe through
+		b.state = breakerHalfOpen
+	}
+	return true
+}
+
+// Success records a successful collection and closes the breaker
+func (b *circuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.state = breakerClosed
+	b.failures = 0
+	b.skip = 0
+	b.remaining = 0
+}
+
+// Failure records a failed collection, opening the breaker once the
+// threshold is reached and backing off further when a probe fails
+func (b *circuitBreaker) Failure() {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	switch {
+	case b.state == breakerHalfOpen:
+		b.skip *= 2
+	case b.failures >= b.threshold:
+		b.skip = 1
+	default:
+		return
+	}
+
+	if b.skip > b.maxSkip {
+		b.skip = b.maxSkip
+	}
+	b.state = breakerOpen
+	b.remaining = b.skip
+}
+
+// State returns the current state of the breaker
+func (b *circuitBreaker) State() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
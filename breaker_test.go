@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestCircuitBreaker(t *testing.T) {
+	// Steps are f for a failure, s for a success, and a or x for a
+	// collection the breaker should allow or skip
+	tests := []struct {
+		name      string
+		threshold int
+		maxSkip   int
+		steps     string
+		want      breakerState
+	}{
+		{name: "closed", threshold: 2, maxSkip: 4, steps: "aaa", want: breakerClosed},
+		{name: "below threshold", threshold: 2, maxSkip: 4, steps: "fa", want: breakerClosed},
+		{name: "opens at threshold", threshold: 2, maxSkip: 4, steps: "ff", want: breakerOpen},
+		{name: "probes after skipping", threshold: 2, maxSkip: 4, steps: "ffxa", want: breakerHalfOpen},
+		{name: "failed probe backs off", threshold: 2, maxSkip: 4, steps: "ffxafxxa", want: breakerHalfOpen},
+		{name: "backoff is capped", threshold: 2, maxSkip: 4, steps: "ffxafxxafxxxxafxxxxa", want: breakerHalfOpen},
+		{name: "successful probe closes", threshold: 2, maxSkip: 4, steps: "ffxas", want: breakerClosed},
+		{name: "success resets failures", threshold: 2, maxSkip: 4, steps: "ffxasfa", want: breakerClosed},
+		{name: "success between failures", threshold: 2, maxSkip: 4, steps: "fsfa", want: breakerClosed},
+		{name: "disabled", threshold: 0, maxSkip: 4, steps: "fffffa", want: breakerClosed},
+		{name: "skips at least one interval", threshold: 1, maxSkip: 0, steps: "fxafxa", want: breakerHalfOpen},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newCircuitBreaker(tt.threshold, tt.maxSkip)
+			for i, step := range tt.steps {
+				switch step {
+				case 'f':
+					b.Failure()
+				case 's':
+					b.Success()
+				case 'a', 'x':
+					if got := b.Allow(); got != (step == 'a') {
+						t.Fatalf("step %d: Allow() = %v, want %v", i, got, step == 'a')
+					}
+				}
+			}
+			if got := b.State(); got != tt.want {
+				t.Errorf("State() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
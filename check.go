@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// checkMetricName is the metric family shared by check metrics, which are
+// told apart by their check label
+const checkMetricName = "sqlmetrics_check_up"
+
+// checkLabel is the label holding a check metric's name
+const checkLabel = "check"
+
+// checkValue normalizes a check query's value to 1 for healthy and 0 for
+// unhealthy. Numbers are healthy when not zero, and text may also be a
+// boolean word like "true", "no" or "ok". Values that aren't boolean-ish
+// report false.
+func checkValue(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case []byte:
+		return checkValue(string(v))
+	case string:
+		switch strings.ToLower(strings.TrimSpace(v)) {
+		case "ok", "yes", "y", "on", "up", "healthy":
+			return 1, true
+		case "no", "n", "off", "down", "unhealthy":
+			return 0, true
+		}
+		if b, err := strconv.ParseBool(strings.TrimSpace(v)); err == nil {
+			return checkValue(b)
+		}
+	}
+
+	f, ok := toFloat64(value)
+	if !ok {
+		return 0, false
+	}
+	if f != 0 {
+		return 1, true
+	}
+	return 0, true
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckValue(t *testing.T) {
+	tests := []struct {
+		value  interface{}
+		want   int64
+		wantOK bool
+	}{
+		{value: true, want: 1, wantOK: true},
+		{value: false, want: 0, wantOK: true},
+		{value: int64(1), want: 1, wantOK: true},
+		{value: int64(0), want: 0, wantOK: true},
+		{value: 0.5, want: 1, wantOK: true},
+		{value: []byte("t"), want: 1, wantOK: true},
+		{value: []byte("FALSE"), want: 0, wantOK: true},
+		{value: []byte(" ok "), want: 1, wantOK: true},
+		{value: []byte("Healthy"), want: 1, wantOK: true},
+		{value: "down", want: 0, wantOK: true},
+		{value: "no", want: 0, wantOK: true},
+		{value: []byte("0"), want: 0, wantOK: true},
+		{value: []byte("maybe"), wantOK: false},
+		{value: nil, wantOK: false},
+	}
+	for _, tt := range tests {
+		got, ok := checkValue(tt.value)
+		if ok != tt.wantOK || (ok && got != tt.want) {
+			t.Errorf("checkValue(%#v) = %d, %v, want %d, %v", tt.value, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestChecks(t *testing.T) {
+	captureLog(t)
+	app := newTestApp(t, `{
+		"database": {"driver": "mock", "mock": [
+			{"query": "SELECT lag_seconds < 30 AS value FROM replication_status", "columns": ["value"], "rows": [[1]]},
+			{"query": "SELECT state AS value FROM queue_status", "columns": ["value"], "rows": [["down"]]},
+			{"query": "SELECT shard, state AS value FROM shards", "columns": ["shard", "value"], "rows": [["a", "yes"], ["b", "no"], ["c", "unknown"]]}
+		]},
+		"metrics": [
+			{"name": "replication", "query": "SELECT lag_seconds < 30 AS value FROM replication_status", "type": "check"},
+			{"name": "queue", "query": "SELECT state AS value FROM queue_status", "type": "check"},
+			{"name": "shards", "query": "SELECT shard, state AS value FROM shards", "type": "check"}
+		]
+	}`)
+
+	// All checks share one family, told apart by their check label
+	body := scrape(t, app, "/metrics")
+	wantLines(t, body,
+		"# TYPE sqlmetrics_check_up gauge",
+		`sqlmetrics_check_up{check="replication"} 1`,
+		`sqlmetrics_check_up{check="queue"} 0`,
+		`sqlmetrics_check_up{check="shards",shard="a"} 1`,
+		`sqlmetrics_check_up{check="shards",shard="b"} 0`,
+	)
+	if n := strings.Count(body, "# TYPE sqlmetrics_check_up "); n != 1 {
+		t.Errorf("/metrics has %d TYPE lines for the checks, want 1:\n%s", n, body)
+	}
+	if strings.Contains(body, `shard="c"`) {
+		t.Errorf("/metrics has a check whose value isn't boolean-ish:\n%s", body)
+	}
+
+	for _, conflict := range []string{`"presence_only": true`, `"name_column": "name"`, `"delta": true`} {
+		_, err := parseConfig(strings.NewReader(`{
+			"database": {"driver": "mock"},
+			"metrics": [{"name": "m", "query": "SELECT 1 AS value", "type": "check", `+conflict+`}]
+		}`), "test config", configFormatJSON, false)
+		if err == nil || !strings.Contains(err.Error(), "metric m is a check") {
+			t.Errorf("check with %s: parseConfig() error = %v, want it rejected", conflict, err)
+		}
+	}
+}
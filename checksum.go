@@ -0,0 +1,18 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"slices"
+)
+
+// resultChecksum returns a checksum of a query's series, covering the key
+// and value of each, so it only changes when the result does
+func resultChecksum(series map[string]timeSeries) uint64 {
+	h := fnv.New64a()
+	for _, key := range slices.Sorted(maps.Keys(series)) {
+		fmt.Fprintf(h, "%s\x00%s\x00", key, labelString(series[key].value))
+	}
+	return h.Sum64()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestResultChecksum(t *testing.T) {
+	base := map[string]timeSeries{
+		`orders{status="open"}`:    {value: int64(3)},
+		`orders{status="shipped"}`: {value: int64(5)},
+	}
+	same := map[string]timeSeries{
+		`orders{status="shipped"}`: {value: int64(5)},
+		`orders{status="open"}`:    {value: int64(3)},
+	}
+	if resultChecksum(base) != resultChecksum(same) {
+		t.Error("resultChecksum() differs for the same series")
+	}
+
+	for name, changed := range map[string]map[string]timeSeries{
+		"value": {
+			`orders{status="open"}`:    {value: int64(4)},
+			`orders{status="shipped"}`: {value: int64(5)},
+		},
+		"labels": {
+			`orders{status="open"}`:     {value: int64(3)},
+			`orders{status="returned"}`: {value: int64(5)},
+		},
+		"missing series": {
+			`orders{status="open"}`: {value: int64(3)},
+		},
+	} {
+		if resultChecksum(base) == resultChecksum(changed) {
+			t.Errorf("resultChecksum() unchanged by a different %s", name)
+		}
+	}
+}
+
+func TestResultChanges(t *testing.T) {
+	app := newTestApp(t, `{
+		"database": {"driver": "mock", "mock": [
+			{"query": "SELECT 1 AS value", "columns": ["value"], "rows": [[1]]},
+			{"query": "SELECT 2 AS value", "columns": ["value"], "rows": [[2]]}
+		]},
+		"metrics": [
+			{"name": "stuck", "query": "SELECT 1 AS value"},
+			{"name": "moving", "query": "SELECT 1 AS value"}
+		]
+	}`)
+	ctx := context.Background()
+	stuck, moving := app.config.Metrics[0], app.config.Metrics[1]
+
+	// The first collection has nothing to compare with
+	wantLines(t, scrape(t, app, "/metrics"),
+		`sqlmetrics_result_changes_total{metric="stuck"} 0`,
+		`sqlmetrics_result_changes_total{metric="moving"} 0`,
+	)
+
+	changed := moving
+	changed.Query = "SELECT 2 AS value"
+	for _, m := range []MetricConfig{stuck, stuck, moving, changed, changed, moving} {
+		if err := app.runQuery(ctx, m); err != nil {
+			t.Fatalf("runQuery(%s) error = %v", m.Name, err)
+		}
+	}
+	wantLines(t, scrape(t, app, "/metrics"),
+		`sqlmetrics_result_changes_total{metric="stuck"} 0`,
+		`sqlmetrics_result_changes_total{metric="moving"} 2`,
+	)
+}
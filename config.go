@@ -1,19 +1,131 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
 )
 
+// currentConfigVersion is the newest config file format understood by LoadConfig
+const currentConfigVersion = 1
+
+// configMigrations upgrade a decoded config file from the version at their
+// index to the next version
+var configMigrations = []func(*jsonConfig){
+	// Version 0 configs predate versioning and need no changes
+	func(*jsonConfig) {},
+}
+
 // jsonConfig is used to unmarshal the JSON configuration file
 type jsonConfig struct {
+	// Version is the config file format version, 0 for unversioned configs
+	Version int `json:"version"`
+	// Strict makes unknown fields an error instead of a warning
+	Strict bool `json:"strict"`
+
 	Port     int                `json:"port"`
 	Interval string             `json:"interval"`
 	Metrics  []jsonMetricConfig `json:"metrics"`
 	Database DatabaseConfig     `json:"database"`
+
+	Databases map[string]DatabaseConfig `json:"databases"`
+
+	SourceLabel string `json:"source_label"`
+
+	UnixSocket string `json:"unix_socket"`
+	AdminToken string `json:"admin_token"`
+	MaskSecret string `json:"mask_secret"`
+
+	ExposeQueries bool `json:"expose_queries"`
+
+	CircuitBreaker jsonCircuitBreakerConfig `json:"circuit_breaker"`
+
+	HealthCheck jsonHealthCheckConfig `json:"health_check"`
+
+	Probe jsonProbeConfig `json:"probe"`
+
+	Server ServerConfig `json:"server"`
+
+	Push jsonPushConfig `json:"push"`
+
+	FailureWebhook jsonWebhookConfig `json:"failure_webhook"`
+
+	TextfilePath string `json:"textfile_path"`
+
+	IdlePause string `json:"idle_pause"`
+
+	SharedTimestamp string `json:"shared_timestamp"`
+
+	AutoLimit int `json:"auto_limit"`
+
+	StartupRetries       int    `json:"startup_retries"`
+	StartupRetryInterval string `json:"startup_retry_interval"`
+
+	ConcurrencyFactor float64 `json:"concurrency_factor"`
+
+	CollectorStartBatch *int `json:"collector_start_batch"`
+
+	AutoTimeoutFraction float64 `json:"auto_timeout_fraction"`
+
+	Vault VaultConfig `json:"vault"`
+
+	AllowEnvOverrides *bool    `json:"allow_env_overrides"`
+	EnvOverrides      []string `json:"env_overrides"`
+}
+
+// jsonCircuitBreakerConfig is used to unmarshal the circuit breaker configuration
+type jsonCircuitBreakerConfig struct {
+	Retries    int    `json:"retries"`
+	Threshold  int    `json:"threshold"`
+	MaxBackoff string `json:"max_backoff"`
+}
+
+// jsonHealthCheckConfig is used to unmarshal the health check configuration
+type jsonHealthCheckConfig struct {
+	Timeout string `json:"timeout"`
+	Retries int    `json:"retries"`
+}
+
+// jsonProbeConfig is used to unmarshal the probe configuration
+type jsonProbeConfig struct {
+	Driver  string   `json:"driver"`
+	Targets []string `json:"targets"`
+	Timeout string   `json:"timeout"`
+}
+
+// jsonPushConfig is used to unmarshal the push configuration
+type jsonPushConfig struct {
+	URL      string `json:"url"`
+	Interval string `json:"interval"`
+	Delta    bool   `json:"delta"`
+}
+
+// jsonWebhookConfig is used to unmarshal the failure webhook configuration
+type jsonWebhookConfig struct {
+	URL         string `json:"url"`
+	MinInterval string `json:"min_interval"`
 }
 
 // jsonMetricConfig is used to unmarshal the metric configuration
@@ -21,21 +133,101 @@ type jsonMetricConfig struct {
 	Name     string `json:"name"`
 	Query    string `json:"query"`
 	Interval string `json:"interval"`
+
+	Type string `json:"type"`
+
+	HistogramBuckets []float64 `json:"histogram_buckets"`
+
+	Min       *float64 `json:"min"`
+	Max       *float64 `json:"max"`
+	ClampMode string   `json:"clamp_mode"`
+
+	NameColumn string `json:"name_column"`
+	TypeColumn string `json:"type_column"`
+
+	MaxOpen int `json:"max_open"`
+	MaxIdle int `json:"max_idle"`
+
+	SampleEvery int `json:"sample_every"`
+
+	StringValueAsLabel bool `json:"string_value_as_label"`
+
+	PresenceOnly bool `json:"presence_only"`
+
+	ValueColumn  string              `json:"value_column"`
+	ValueColumns []ValueColumnConfig `json:"value_columns"`
+
+	TimestampColumn string `json:"timestamp_column"`
+
+	Scalar     bool   `json:"scalar"`
+	OnMultiRow string `json:"on_multi_row"`
+
+	ExpectedColumns  []string `json:"expected_columns"`
+	CheckColumnOrder bool     `json:"check_column_order"`
+
+	MinRows *int `json:"min_rows"`
+	MaxRows *int `json:"max_rows"`
+
+	LatestRowOnly bool   `json:"latest_row_only"`
+	LatestRow     string `json:"latest_row"`
+
+	Labels map[string]string `json:"labels"`
+
+	MaskLabels []string `json:"mask_labels"`
+	MaskMode   string   `json:"mask_mode"`
+
+	Unit string `json:"unit"`
+
+	ValueFormat string `json:"value_format"`
+
+	DecimalSeparator string `json:"decimal_separator"`
+
+	DependsOn []string `json:"depends_on"`
+
+	MetricName string `json:"metric_name"`
+
+	Database string `json:"database"`
+
+	OnScrape bool     `json:"on_scrape"`
+	Params   []string `json:"params"`
+
+	MetadataQuery    string `json:"metadata_query"`
+	MetadataInterval string `json:"metadata_interval"`
+
+	DuplicateColumns string `json:"duplicate_columns"`
+
+	RowFilter string `json:"row_filter"`
+
+	StaleAfter string `json:"stale_after"`
+
+	Output string `json:"output"`
+
+	Delta bool `json:"delta"`
+
+	TrackRowsExamined bool `json:"track_rows_examined"`
+
+	FailureWebhookURL string `json:"failure_webhook_url"`
+
+	Phase string `json:"phase"`
+
+	Timeout string `json:"timeout"`
 }
 
-// LoadConfig loads the application configuration from a file
-func LoadConfig(path string) (Config, error) {
-	config := Config{
-		Port:     8080,
-		Interval: 60 * time.Second,
-		Database: DatabaseConfig{
-			Driver:   "mysql",
-			DSN:      "user:password@tcp(host:3306)/database",
-			MaxOpen:  10,
-			MaxIdle:  5,
-			Lifetime: 300,
-		},
-		Metrics: []MetricConfig{},
+// LoadConfig loads the application configuration from a file, or from an
+// HTTP(S) URL. In strict mode unknown fields in the config are an error even
+// if the config doesn't set strict itself.
+func LoadConfig(path string, strict bool) (Config, error) {
+	if isConfigURL(path) {
+		data, etag, err := fetchConfig(context.Background(), path, "")
+		if err != nil {
+			return Config{}, fmt.Errorf("error fetching config: %w", err)
+		}
+		config, err := parseConfig(bytes.NewReader(data), "config from "+path, configFormat(path), strict)
+		if err != nil {
+			return Config{}, err
+		}
+		config.etag, config.checksum = etag, sha256.Sum256(data)
+		return config, nil
 	}
 
 	// Load from file if it exists
@@ -43,84 +235,1067 @@ func LoadConfig(path string) (Config, error) {
 		file, err := os.Open(path)
 		if err != nil {
 			if !os.IsNotExist(err) {
-				return config, fmt.Errorf("error opening config file: %w", err)
+				return Config{}, fmt.Errorf("error opening config file: %w", err)
 			}
 			// File doesn't exist, we'll use environment variables or defaults
-		} else {
-			defer file.Close()
+			return parseConfig(nil, "", configFormatJSON, strict)
+		}
+		defer file.Close()
+		return parseConfig(file, "config file", configFormat(path), strict)
+	}
 
-			var jsonCfg jsonConfig
-			decoder := json.NewDecoder(file)
-			if err := decoder.Decode(&jsonCfg); err != nil {
-				return config, fmt.Errorf("error decoding config file: %w", err)
-			}
+	// No file given, load the whole config from the environment instead
+	if configJSON := os.Getenv("CONFIG_JSON"); configJSON != "" {
+		return parseConfig(strings.NewReader(configJSON), "CONFIG_JSON", configFormatJSON, strict)
+	}
+	return parseConfig(nil, "", configFormatJSON, strict)
+}
+
+// envOverrides are the environment variables that can override the config
+var envOverrides = []string{
+	"PORT", "UNIX_SOCKET", "ADMIN_TOKEN", "VAULT_ADDR", "VAULT_TOKEN", "INTERVAL",
+	"DB_DRIVER", "DB_DSN", "DB_MAX_OPEN", "DB_MAX_IDLE", "DB_LIFETIME",
+}
+
+// envOverrideAllowed reports whether the environment variable name may
+// override the config: any of them unless overrides are disabled, or only
+// those listed in EnvOverrides if it is set
+func (c Config) envOverrideAllowed(name string) bool {
+	if !c.AllowEnvOverrides {
+		return false
+	}
+	return len(c.EnvOverrides) == 0 || slices.Contains(c.EnvOverrides, name)
+}
+
+// Config file formats
+const (
+	configFormatJSON = "json"
+	configFormatYAML = "yaml"
+)
+
+// configFormat returns the format of the config at path, a file or URL, by
+// its extension ignoring a .gz suffix. Configs are JSON unless they end in
+// .yaml or .yml.
+func configFormat(path string) string {
+	if u, err := url.Parse(path); err == nil && isConfigURL(path) {
+		path = u.Path
+	}
+	switch filepath.Ext(strings.TrimSuffix(path, ".gz")) {
+	case ".yaml", ".yml":
+		return configFormatYAML
+	default:
+		return configFormatJSON
+	}
+}
+
+// yamlToJSON converts a YAML config to JSON, so it is decoded and checked
+// for unknown fields just like a JSON config
+func yamlToJSON(r io.Reader) (io.Reader, error) {
+	var doc interface{}
+	if err := yaml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
+
+// Validate checks a loaded config for problems that would otherwise be
+// silently defaulted or only show up once collection runs: duplicate or
+// empty metric names, empty queries, invalid durations, intervals and
+// timeouts that aren't positive, entries describing a shared metric family
+// differently, and invalid ports. The returned error lists
+// every problem found.
+func (c Config) Validate() error {
+	errs := append([]error(nil), c.problems...)
+
+	if c.Port < 0 || c.Port > 65535 {
+		errs = append(errs, fmt.Errorf("port %d is not between 0 and 65535", c.Port))
+	}
+
+	// Collections tick at their interval, which must be positive
+	if c.Interval <= 0 {
+		errs = append(errs, fmt.Errorf("interval %s is not positive", c.Interval))
+	}
+
+	seen := make(map[string]bool, len(c.Metrics))
+	for i, metric := range c.Metrics {
+		name := metric.Name
+		switch {
+		case name == "":
+			name = fmt.Sprintf("#%d", i+1)
+			errs = append(errs, fmt.Errorf("metric %s has no name", name))
+		case seen[name]:
+			errs = append(errs, fmt.Errorf("metric name %s is used more than once", name))
+		}
+		seen[metric.Name] = true
+
+		if strings.TrimSpace(metric.Query) == "" {
+			errs = append(errs, fmt.Errorf("metric %s has no query", name))
+		}
+
+		// An unkeyed hash of a guessable value is easily reversed
+		if len(metric.MaskLabels) > 0 && metric.MaskMode == maskModeHash && c.MaskSecret == "" {
+			errs = append(errs, fmt.Errorf("metric %s masks labels in hash mode, which needs mask_secret", name))
+		}
 
-			// Convert JSON config to application config
-			config.Port = jsonCfg.Port
+		if metric.Interval <= 0 {
+			errs = append(errs, fmt.Errorf("metric %s has interval %s, which is not positive", name, metric.Interval))
+		}
+		if metric.Timeout < 0 {
+			errs = append(errs, fmt.Errorf("metric %s has timeout %s, which is not positive", name, metric.Timeout))
+		}
+	}
+	errs = append(errs, familyConflicts(c.Metrics)...)
+
+	return errors.Join(errs...)
+}
+
+// familyDescription is how a config entry describes a metric family it
+// exposes
+type familyDescription struct {
+	entry      string
+	metricType string
+	unit       string
+	help       string
+}
 
-			if interval, err := time.ParseDuration(jsonCfg.Interval); err == nil {
-				config.Interval = interval
+// familyConflicts returns a problem for each metric family whose entries
+// disagree on its type, unit or help. A family has a single HELP/TYPE block,
+// so the entries sharing it must describe it alike. Families named by a
+// name_column are only known once the query runs.
+func familyConflicts(metrics []MetricConfig) []error {
+	var errs []error
+	families := make(map[string]familyDescription)
+	describe := func(name string, desc familyDescription) {
+		first, ok := families[name]
+		if !ok {
+			families[name] = desc
+			return
+		}
+		for _, attr := range []struct{ name, first, other string }{
+			{"type", first.metricType, desc.metricType},
+			{"unit", first.unit, desc.unit},
+			{"help", first.help, desc.help},
+		} {
+			if attr.first != attr.other {
+				errs = append(errs, fmt.Errorf("metrics %s and %s both expose %s, but with %s %q and %q", first.entry, desc.entry, name, attr.name, attr.first, attr.other))
 			}
+		}
+	}
 
-			config.Database = jsonCfg.Database
+	for _, metric := range metrics {
+		if metric.NameColumn != "" {
+			continue
+		}
+		if len(metric.ValueColumns) == 0 {
+			describe(metric.MetricName, familyDescription{entry: metric.Name, metricType: metric.Type, unit: metric.Unit})
+			continue
+		}
+		for _, col := range metric.ValueColumns {
+			metricType := metric.Type
+			if col.Type != "" {
+				metricType = col.Type
+			}
+			describe(metric.MetricName+"_"+col.Column, familyDescription{entry: metric.Name, metricType: metricType, unit: col.Unit, help: col.Help})
+		}
+	}
+	return errs
+}
 
-			// Convert metric configs
-			for _, jsonMetric := range jsonCfg.Metrics {
-				metric := MetricConfig{
-					Name:  jsonMetric.Name,
-					Query: jsonMetric.Query,
-				}
+// metricDriver returns the driver of the database the metric queries
+func (c Config) metricDriver(metric MetricConfig) string {
+	if metric.Database != "" {
+		return c.Databases[metric.Database].Driver
+	}
+	return c.Database.Driver
+}
 
-				if interval, err := time.ParseDuration(jsonMetric.Interval); err == nil {
-					metric.Interval = interval
-				} else {
-					// Default to global interval if parsing fails
-					metric.Interval = config.Interval
-				}
+// parseDuration parses the value of a duration field, reporting whether it
+// was set. A value that can't be parsed is recorded as a problem of the
+// config, named by field, for Validate.
+func (c *Config) parseDuration(field, value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		c.problems = append(c.problems, fmt.Errorf("%s: invalid duration %q", field, value))
+		return 0, false
+	}
+	return d, true
+}
+
+// parsePositiveDuration parses the value of an interval or timeout field
+// like parseDuration, also recording a value that isn't positive as a
+// problem. Such a value isn't reported as set, keeping the default.
+func (c *Config) parsePositiveDuration(field, value string) (time.Duration, bool) {
+	d, ok := c.parseDuration(field, value)
+	if ok && d <= 0 {
+		c.problems = append(c.problems, fmt.Errorf("%s: duration %s is not positive", field, value))
+		return 0, false
+	}
+	return d, ok
+}
+
+// envReference matches a ${NAME} reference to an environment variable, or
+// the escaped $${ of a literal ${
+var envReference = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces the ${NAME} references in value with the environment
+// variables they name, recording unset variables as problems with field. Only
+// the braced form is expanded, so a $ elsewhere, e.g. in a password, is kept.
+func (c *Config) expandEnv(field, value string) string {
+	return envReference.ReplaceAllStringFunc(value, func(ref string) string {
+		if ref == "$${" {
+			return "${"
+		}
+		name := ref[2 : len(ref)-1]
+		env, ok := os.LookupEnv(name)
+		if !ok {
+			c.problems = append(c.problems, fmt.Errorf("%s: environment variable %s is not set", field, name))
+		}
+		return env
+	})
+}
+
+// gzipMagic are the first bytes of gzip data
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// decompressConfig transparently decompresses a gzipped config, detected by
+// its magic bytes rather than a .gz extension so configs fetched from a URL
+// are handled too. Other configs are returned as they are.
+func decompressConfig(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(gzipMagic))
+	if err != nil || !bytes.Equal(magic, gzipMagic) {
+		// Too short to be gzipped, leave the error to the decoder
+		return br, nil
+	}
+	return gzip.NewReader(br)
+}
 
-				config.Metrics = append(config.Metrics, metric)
+// parseConfig decodes a config in format from r, named source in errors, on
+// top of the defaults and applies the environment overrides. Without r only
+// the defaults and environment are used.
+func parseConfig(r io.Reader, source, format string, strict bool) (Config, error) {
+	config := Config{
+		Port:     8080,
+		Interval: 60 * time.Second,
+		Database: DatabaseConfig{
+			Driver:   "mysql",
+			DSN:      "user:password@tcp(host:3306)/database",
+			MaxOpen:  10,
+			MaxIdle:  5,
+			Lifetime: 300,
+		},
+		Metrics: []MetricConfig{},
+		CircuitBreaker: CircuitBreakerConfig{
+			MaxBackoff: 10 * time.Minute,
+		},
+		HealthCheck: HealthCheckConfig{
+			Timeout: 5 * time.Second,
+		},
+		Probe: ProbeConfig{
+			Timeout: 10 * time.Second,
+		},
+		FailureWebhook: WebhookConfig{
+			MinInterval: 5 * time.Minute,
+		},
+		StartupRetryInterval: time.Second,
+		Server: ServerConfig{
+			TLS: ServerTLSConfig{MinVersion: "1.2"},
+		},
+		ConcurrencyFactor:   4,
+		CollectorStartBatch: 100,
+		AutoTimeoutFraction: 0.8,
+		AllowEnvOverrides:   true,
+	}
+
+	if r != nil {
+		r, err := decompressConfig(r)
+		if err != nil {
+			return config, fmt.Errorf("error decompressing %s: %w", source, err)
+		}
+		if format == configFormatYAML {
+			if r, err = yamlToJSON(r); err != nil {
+				return config, fmt.Errorf("error decoding %s: %w", source, err)
 			}
 		}
+		if err := decodeConfig(r, &config, strict); err != nil {
+			return config, fmt.Errorf("error decoding %s: %w", source, err)
+		}
+	}
+
+	// Secrets in the DSNs and the mask secret can be kept in the environment
+	config.Database.DSN = config.expandEnv("database.dsn", config.Database.DSN)
+	for name, db := range config.Databases {
+		db.DSN = config.expandEnv("databases."+name+".dsn", db.DSN)
+		config.Databases[name] = db
 	}
+	config.MaskSecret = config.expandEnv("mask_secret", config.MaskSecret)
 
-	// Override with environment variables if they exist
-	if port := os.Getenv("PORT"); port != "" {
+	// Override with environment variables if they exist and the config
+	// allows them
+	getenv := func(name string) string {
+		if !config.envOverrideAllowed(name) {
+			return ""
+		}
+		return os.Getenv(name)
+	}
+	if port := getenv("PORT"); port != "" {
 		if p, err := strconv.Atoi(port); err == nil {
 			config.Port = p
+		} else {
+			config.problems = append(config.problems, fmt.Errorf("PORT: invalid port %q", port))
 		}
 	}
 
-	if interval := os.Getenv("INTERVAL"); interval != "" {
-		if i, err := time.ParseDuration(interval); err == nil {
-			config.Interval = i
-		}
+	if socket := getenv("UNIX_SOCKET"); socket != "" {
+		config.UnixSocket = socket
 	}
 
-	if driver := os.Getenv("DB_DRIVER"); driver != "" {
+	if token := getenv("ADMIN_TOKEN"); token != "" {
+		config.AdminToken = token
+	}
+
+	// The standard Vault variables fill in what the config leaves out
+	if addr := getenv("VAULT_ADDR"); addr != "" && config.Vault.Address == "" {
+		config.Vault.Address = addr
+	}
+
+	if token := getenv("VAULT_TOKEN"); token != "" && config.Vault.Token == "" {
+		config.Vault.Token = token
+	}
+
+	if i, ok := config.parsePositiveDuration("INTERVAL", getenv("INTERVAL")); ok {
+		config.Interval = i
+	}
+
+	if driver := getenv("DB_DRIVER"); driver != "" {
 		config.Database.Driver = driver
 	}
 
-	if dsn := os.Getenv("DB_DSN"); dsn != "" {
+	if dsn := getenv("DB_DSN"); dsn != "" {
 		config.Database.DSN = dsn
 	}
 
-	if maxOpen := os.Getenv("DB_MAX_OPEN"); maxOpen != "" {
+	if maxOpen := getenv("DB_MAX_OPEN"); maxOpen != "" {
 		if mo, err := strconv.Atoi(maxOpen); err == nil {
 			config.Database.MaxOpen = mo
 		}
 	}
 
-	if maxIdle := os.Getenv("DB_MAX_IDLE"); maxIdle != "" {
+	if maxIdle := getenv("DB_MAX_IDLE"); maxIdle != "" {
 		if mi, err := strconv.Atoi(maxIdle); err == nil {
 			config.Database.MaxIdle = mi
 		}
 	}
 
-	if lifetime := os.Getenv("DB_LIFETIME"); lifetime != "" {
+	if lifetime := getenv("DB_LIFETIME"); lifetime != "" {
 		if lt, err := strconv.Atoi(lifetime); err == nil {
 			config.Database.Lifetime = lt
 		}
 	}
 
+	if _, err := dependencyOrders(config.Metrics); err != nil {
+		return config, fmt.Errorf("error in metric dependencies: %w", err)
+	}
+
+	if config.SourceLabel != "" && !labelNameRegexp.MatchString(config.SourceLabel) {
+		return config, fmt.Errorf("source label %q is not a valid label name", config.SourceLabel)
+	}
+
+	if !driverSupported(config.Database.Driver) {
+		return config, fmt.Errorf("unsupported database driver %q, supported drivers are: %s",
+			config.Database.Driver, strings.Join(supportedDrivers(), ", "))
+	}
+	for name, dbConfig := range config.Databases {
+		if !driverSupported(dbConfig.Driver) {
+			return config, fmt.Errorf("database %s has unsupported driver %q, supported drivers are: %s",
+				name, dbConfig.Driver, strings.Join(supportedDrivers(), ", "))
+		}
+	}
+	if config.Probe.Driver != "" && !driverSupported(config.Probe.Driver) {
+		return config, fmt.Errorf("probe has unsupported driver %q, supported drivers are: %s",
+			config.Probe.Driver, strings.Join(supportedDrivers(), ", "))
+	}
+
+	if auth := config.Server.BasicAuth; auth != nil {
+		if auth.Username == "" || auth.PasswordHash == "" {
+			return config, fmt.Errorf("server.basic_auth needs a username and a password_hash")
+		}
+		if _, err := bcrypt.Cost([]byte(auth.PasswordHash)); err != nil {
+			return config, fmt.Errorf("server.basic_auth.password_hash isn't a bcrypt hash: %w", err)
+		}
+	}
+
+	serverTLS := config.Server.TLS
+	if (serverTLS.CertFile == "") != (serverTLS.KeyFile == "") {
+		return config, fmt.Errorf("server.tls.cert_file and server.tls.key_file must be set together")
+	}
+	if serverTLS.ClientCAFile != "" && serverTLS.CertFile == "" {
+		return config, fmt.Errorf("server.tls.client_ca_file needs TLS, set server.tls.cert_file and server.tls.key_file")
+	}
+	if serverTLS.RequireClientCert && serverTLS.ClientCAFile == "" {
+		return config, fmt.Errorf("server.tls.require_client_cert needs a server.tls.client_ca_file to verify client certificates with")
+	}
+	if _, ok := tlsVersions[serverTLS.MinVersion]; !ok {
+		return config, fmt.Errorf("server.tls.min_version %q is unsupported, use 1.0, 1.1, 1.2 or 1.3", serverTLS.MinVersion)
+	}
+
+	// As a safety net, queries that don't limit their rows get a LIMIT
+	if config.AutoLimit > 0 {
+		for i, metric := range config.Metrics {
+			if !autoLimitDrivers[config.metricDriver(metric)] {
+				continue
+			}
+			if query, ok := injectLimit(metric.Query, config.AutoLimit); ok {
+				config.Metrics[i].Query = query
+			}
+		}
+	}
+
+	// Pushed and written metrics are consumed without scrapes
+	if config.IdlePause > 0 && (config.Push.URL != "" || config.TextfilePath != "") {
+		return config, fmt.Errorf("idle_pause can't be used with push or textfile_path, which don't scrape the metrics")
+	}
+
+	if _, ok := config.Databases[defaultDatabase]; ok {
+		return config, fmt.Errorf("database name %q is reserved for the main database", defaultDatabase)
+	}
+	onScrape := make(map[string]bool)
+	for _, metric := range config.Metrics {
+		if _, ok := config.Databases[metric.Database]; metric.Database != "" && !ok {
+			return config, fmt.Errorf("metric %s uses unknown database %s", metric.Name, metric.Database)
+		}
+
+		if !metricTypes[metric.Type] {
+			return config, fmt.Errorf("metric %s has unsupported type %q", metric.Name, metric.Type)
+		}
+		if len(metric.HistogramBuckets) > 0 {
+			if metric.Type != "histogram" || metric.NameColumn != "" {
+				return config, fmt.Errorf("metric %s has histogram buckets, so it must be a histogram without a name_column", metric.Name)
+			}
+			for i, bound := range metric.HistogramBuckets {
+				if i > 0 && bound <= metric.HistogramBuckets[i-1] {
+					return config, fmt.Errorf("metric %s has histogram buckets that aren't in increasing order", metric.Name)
+				}
+			}
+		} else if compositeType(metric.Type) && metric.NameColumn == "" {
+			return config, fmt.Errorf("metric %s is a %s, which needs a name_column naming its samples", metric.Name, metric.Type)
+		}
+
+		if metric.Scalar && (len(metric.ValueColumns) > 0 || metric.PresenceOnly || metric.NameColumn != "") {
+			return config, fmt.Errorf("metric %s is scalar, so it can't have value_columns, presence_only or a name_column", metric.Name)
+		}
+		switch metric.OnMultiRow {
+		case multiRowError, multiRowFirst, multiRowLast, multiRowSum:
+		default:
+			return config, fmt.Errorf("metric %s has unsupported on_multi_row %q", metric.Name, metric.OnMultiRow)
+		}
+		if len(metric.ValueColumns) > 0 {
+			if metric.PresenceOnly || metric.StringValueAsLabel || metric.NameColumn != "" || compositeType(metric.Type) {
+				return config, fmt.Errorf("metric %s has value_columns, so it must be a gauge or counter without presence_only, string_value_as_label or a name_column", metric.Name)
+			}
+			for _, col := range metric.ValueColumns {
+				if col.Column == "" {
+					return config, fmt.Errorf("metric %s has a value column without a column name", metric.Name)
+				}
+				if !validMetricName(metric.MetricName + "_" + col.Column) {
+					return config, fmt.Errorf("metric %s has value column %q, which doesn't make a valid metric name", metric.Name, col.Column)
+				}
+				if col.Type != "" && col.Type != "gauge" && col.Type != "counter" {
+					return config, fmt.Errorf("metric %s has value column %q of unsupported type %q, value columns may be gauges or counters", metric.Name, col.Column, col.Type)
+				}
+			}
+		}
+
+		if metric.TimestampColumn != "" {
+			if compositeType(metric.Type) {
+				return config, fmt.Errorf("metric %s has a timestamp_column, which isn't supported for histograms and summaries", metric.Name)
+			}
+			// The Pushgateway and the textfile collector reject timestamps
+			pushed := metric.Output == outputPush || (metric.Output == "" && config.Push.URL != "")
+			written := metric.Output == outputTextfile || (metric.Output == "" && config.TextfilePath != "")
+			if pushed || written {
+				return config, fmt.Errorf("metric %s has a timestamp_column, so it must be output to scrape only, the Pushgateway and textfile collector don't accept timestamps", metric.Name)
+			}
+		}
+
+		if metric.check && (len(metric.ValueColumns) > 0 || metric.PresenceOnly || metric.StringValueAsLabel || metric.NameColumn != "" || metric.Delta) {
+			return config, fmt.Errorf("metric %s is a check, so it can't have value_columns, presence_only, string_value_as_label, a name_column or delta", metric.Name)
+		}
+
+		if metric.Delta && (metric.OnScrape || compositeType(metric.Type)) {
+			return config, fmt.Errorf("metric %s is a delta, which isn't supported for on-scrape metrics, histograms and summaries", metric.Name)
+		}
+
+		if metric.TrackRowsExamined {
+			if driver := config.metricDriver(metric); !rowsExaminedDrivers[driver] {
+				return config, fmt.Errorf("metric %s tracks rows examined, which isn't supported by driver %q", metric.Name, driver)
+			}
+		}
+
+		switch metric.Output {
+		case "", outputScrape:
+		case outputPush:
+			if config.Push.URL == "" {
+				return config, fmt.Errorf("metric %s is output to push, but push.url isn't set", metric.Name)
+			}
+		case outputTextfile:
+			if config.TextfilePath == "" {
+				return config, fmt.Errorf("metric %s is output to textfile, but textfile_path isn't set", metric.Name)
+			}
+		default:
+			return config, fmt.Errorf("metric %s has unsupported output %q", metric.Name, metric.Output)
+		}
+
+		for name := range metric.Labels {
+			if !labelNameRegexp.MatchString(name) {
+				return config, fmt.Errorf("metric %s has invalid label name %q", metric.Name, name)
+			}
+		}
+
+		if len(metric.Params) > 0 && !metric.OnScrape {
+			return config, fmt.Errorf("metric %s has params but isn't collected on scrape", metric.Name)
+		}
+		for _, param := range metric.Params {
+			if !labelNameRegexp.MatchString(param) {
+				return config, fmt.Errorf("metric %s has invalid param name %q", metric.Name, param)
+			}
+		}
+		onScrape[metric.Name] = metric.OnScrape
+	}
+
+	// On-scrape metrics aren't collected in the background
+	for _, metric := range config.Metrics {
+		for _, dep := range metric.DependsOn {
+			if metric.OnScrape || onScrape[dep] {
+				return config, fmt.Errorf("metric %s can't depend on %s, dependencies aren't supported for on-scrape metrics", metric.Name, dep)
+			}
+		}
+	}
+
 	return config, nil
 }
+
+// dependencyOrders returns, for every metric, the order its collection cycle
+// runs in: its transitive dependencies with each dependency before the
+// metrics needing it, followed by the metric itself. Unknown dependencies and
+// dependency cycles are an error.
+func dependencyOrders(metrics []MetricConfig) (map[string][]MetricConfig, error) {
+	byName := make(map[string]MetricConfig, len(metrics))
+	for _, metric := range metrics {
+		byName[metric.Name] = metric
+	}
+
+	orders := make(map[string][]MetricConfig, len(metrics))
+	for _, metric := range metrics {
+		var order []MetricConfig
+		visited := make(map[string]bool)
+		onPath := make(map[string]bool)
+
+		var visit func(name string, path []string) error
+		visit = func(name string, path []string) error {
+			if onPath[name] {
+				return fmt.Errorf("dependency cycle %s", strings.Join(append(path, name), " -> "))
+			}
+			if visited[name] {
+				return nil
+			}
+
+			m, ok := byName[name]
+			if !ok {
+				return fmt.Errorf("metric %s depends on unknown metric %s", path[len(path)-1], name)
+			}
+
+			onPath[name] = true
+			for _, dep := range m.DependsOn {
+				if err := visit(dep, append(path, name)); err != nil {
+					return err
+				}
+			}
+			onPath[name] = false
+			visited[name] = true
+
+			order = append(order, m)
+			return nil
+		}
+
+		if err := visit(metric.Name, nil); err != nil {
+			return nil, err
+		}
+		orders[metric.Name] = order
+	}
+
+	return orders, nil
+}
+
+// decodeConfig decodes a JSON configuration from r and applies it on top of config
+func decodeConfig(r io.Reader, config *Config, strict bool) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	var jsonCfg jsonConfig
+	if err := json.Unmarshal(data, &jsonCfg); err != nil {
+		return err
+	}
+
+	// Typo'd or removed fields are otherwise silently ignored
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if unknown := unknownFields(raw, reflect.TypeOf(jsonCfg), ""); len(unknown) > 0 {
+		if strict || jsonCfg.Strict {
+			return fmt.Errorf("unknown config fields: %s", strings.Join(unknown, ", "))
+		}
+		for _, field := range unknown {
+			log.Printf("Warning: ignoring unknown config field %s", field)
+		}
+	}
+
+	// Bring older config formats up to date
+	if jsonCfg.Version > currentConfigVersion {
+		return fmt.Errorf("config version %d is newer than the supported version %d", jsonCfg.Version, currentConfigVersion)
+	}
+	for v := jsonCfg.Version; v < currentConfigVersion; v++ {
+		configMigrations[v](&jsonCfg)
+	}
+
+	// Convert JSON config to application config
+	config.Port = jsonCfg.Port
+
+	if interval, ok := config.parsePositiveDuration("interval", jsonCfg.Interval); ok {
+		config.Interval = interval
+	}
+
+	config.Database = jsonCfg.Database
+	config.Databases = jsonCfg.Databases
+	config.SourceLabel = jsonCfg.SourceLabel
+	config.UnixSocket = jsonCfg.UnixSocket
+	config.AdminToken = jsonCfg.AdminToken
+	config.MaskSecret = jsonCfg.MaskSecret
+	config.ExposeQueries = jsonCfg.ExposeQueries
+	config.Probe.Driver = jsonCfg.Probe.Driver
+	config.Probe.Targets = jsonCfg.Probe.Targets
+	if timeout, ok := config.parsePositiveDuration("probe.timeout", jsonCfg.Probe.Timeout); ok {
+		config.Probe.Timeout = timeout
+	}
+	config.Vault = jsonCfg.Vault
+	config.Server.BasicAuth = jsonCfg.Server.BasicAuth
+	config.Server.BearerToken = jsonCfg.Server.BearerToken
+	serverTLS := jsonCfg.Server.TLS
+	if serverTLS.MinVersion == "" {
+		serverTLS.MinVersion = config.Server.TLS.MinVersion
+	}
+	config.Server.TLS = serverTLS
+
+	if jsonCfg.ConcurrencyFactor > 0 {
+		config.ConcurrencyFactor = jsonCfg.ConcurrencyFactor
+	}
+	if jsonCfg.CollectorStartBatch != nil {
+		config.CollectorStartBatch = *jsonCfg.CollectorStartBatch
+	}
+	if jsonCfg.AutoTimeoutFraction > 0 && jsonCfg.AutoTimeoutFraction <= 1 {
+		config.AutoTimeoutFraction = jsonCfg.AutoTimeoutFraction
+	}
+
+	config.TextfilePath = jsonCfg.TextfilePath
+
+	if pause, ok := config.parseDuration("idle_pause", jsonCfg.IdlePause); ok {
+		config.IdlePause = pause
+	}
+
+	config.AutoLimit = jsonCfg.AutoLimit
+	config.SharedTimestamp = jsonCfg.SharedTimestamp
+	switch config.SharedTimestamp {
+	case "", sharedTimestampScrape, sharedTimestampCollection:
+	default:
+		return fmt.Errorf("unsupported shared_timestamp %q, use %q or %q", config.SharedTimestamp, sharedTimestampScrape, sharedTimestampCollection)
+	}
+
+	config.StartupRetries = jsonCfg.StartupRetries
+	if interval, ok := config.parsePositiveDuration("startup_retry_interval", jsonCfg.StartupRetryInterval); ok {
+		config.StartupRetryInterval = interval
+	}
+
+	if jsonCfg.AllowEnvOverrides != nil {
+		config.AllowEnvOverrides = *jsonCfg.AllowEnvOverrides
+	}
+	config.EnvOverrides = jsonCfg.EnvOverrides
+	for _, name := range config.EnvOverrides {
+		if !slices.Contains(envOverrides, name) {
+			return fmt.Errorf("env_overrides lists unknown variable %s, supported variables are: %s", name, strings.Join(envOverrides, ", "))
+		}
+	}
+
+	config.Push.URL = jsonCfg.Push.URL
+	config.Push.Delta = jsonCfg.Push.Delta
+	if interval, ok := config.parsePositiveDuration("push.interval", jsonCfg.Push.Interval); ok {
+		config.Push.Interval = interval
+	} else {
+		config.Push.Interval = config.Interval
+	}
+
+	config.FailureWebhook.URL = jsonCfg.FailureWebhook.URL
+	if interval, ok := config.parseDuration("failure_webhook.min_interval", jsonCfg.FailureWebhook.MinInterval); ok {
+		config.FailureWebhook.MinInterval = interval
+	}
+
+	config.CircuitBreaker.Retries = jsonCfg.CircuitBreaker.Retries
+	config.CircuitBreaker.Threshold = jsonCfg.CircuitBreaker.Threshold
+	if maxBackoff, ok := config.parseDuration("circuit_breaker.max_backoff", jsonCfg.CircuitBreaker.MaxBackoff); ok {
+		config.CircuitBreaker.MaxBackoff = maxBackoff
+	}
+
+	config.HealthCheck.Retries = jsonCfg.HealthCheck.Retries
+	if timeout, ok := config.parsePositiveDuration("health_check.timeout", jsonCfg.HealthCheck.Timeout); ok {
+		config.HealthCheck.Timeout = timeout
+	}
+
+	// Convert metric configs
+	for i, jsonMetric := range jsonCfg.Metrics {
+		metric := MetricConfig{
+			Name:  jsonMetric.Name,
+			Query: jsonMetric.Query,
+			Type:  jsonMetric.Type,
+
+			HistogramBuckets: jsonMetric.HistogramBuckets,
+
+			Min:       jsonMetric.Min,
+			Max:       jsonMetric.Max,
+			ClampMode: jsonMetric.ClampMode,
+
+			NameColumn: jsonMetric.NameColumn,
+			TypeColumn: jsonMetric.TypeColumn,
+
+			MaxOpen: jsonMetric.MaxOpen,
+			MaxIdle: jsonMetric.MaxIdle,
+
+			SampleEvery: jsonMetric.SampleEvery,
+
+			StringValueAsLabel: jsonMetric.StringValueAsLabel,
+
+			PresenceOnly: jsonMetric.PresenceOnly,
+
+			ValueColumn:  jsonMetric.ValueColumn,
+			ValueColumns: jsonMetric.ValueColumns,
+
+			TimestampColumn: jsonMetric.TimestampColumn,
+
+			Scalar:     jsonMetric.Scalar,
+			OnMultiRow: jsonMetric.OnMultiRow,
+
+			ExpectedColumns:  jsonMetric.ExpectedColumns,
+			CheckColumnOrder: jsonMetric.CheckColumnOrder,
+
+			MinRows: jsonMetric.MinRows,
+			MaxRows: jsonMetric.MaxRows,
+
+			LatestRowOnly: jsonMetric.LatestRowOnly,
+			LatestRow:     jsonMetric.LatestRow,
+
+			Labels: jsonMetric.Labels,
+
+			MaskLabels: jsonMetric.MaskLabels,
+			MaskMode:   jsonMetric.MaskMode,
+
+			Unit:        jsonMetric.Unit,
+			ValueFormat: jsonMetric.ValueFormat,
+
+			DecimalSeparator: jsonMetric.DecimalSeparator,
+
+			DependsOn: jsonMetric.DependsOn,
+
+			MetricName: jsonMetric.MetricName,
+			Database:   jsonMetric.Database,
+
+			OnScrape: jsonMetric.OnScrape,
+			Params:   jsonMetric.Params,
+
+			MetadataQuery: jsonMetric.MetadataQuery,
+
+			DuplicateColumns: jsonMetric.DuplicateColumns,
+
+			RowFilter: jsonMetric.RowFilter,
+
+			Output: jsonMetric.Output,
+
+			Delta: jsonMetric.Delta,
+
+			TrackRowsExamined: jsonMetric.TrackRowsExamined,
+
+			FailureWebhookURL: jsonMetric.FailureWebhookURL,
+		}
+
+		if metric.ClampMode == "" {
+			metric.ClampMode = clampModeClamp
+		}
+		if metric.LatestRow == "" {
+			metric.LatestRow = latestRowLast
+		}
+		if metric.MaskMode == "" {
+			metric.MaskMode = maskModeHash
+		}
+		if metric.ValueFormat == "" {
+			metric.ValueFormat = valueFormatAuto
+		}
+		if metric.DuplicateColumns == "" {
+			metric.DuplicateColumns = duplicateColumnsError
+		}
+		if metric.ValueColumn != "" && len(metric.ValueColumns) > 0 {
+			return fmt.Errorf("metric %s can't have both value_column and value_columns", metric.Name)
+		}
+		if metric.ValueColumn == "" {
+			metric.ValueColumn = "value"
+		}
+		if metric.OnMultiRow == "" {
+			metric.OnMultiRow = multiRowError
+		}
+
+		filter, err := parseRowFilter(metric.RowFilter)
+		if err != nil {
+			return fmt.Errorf("metric %s has an invalid row filter: %w", metric.Name, err)
+		}
+		metric.rowFilter = filter
+		if metric.Type == "check" {
+			// Checks share one family, told apart by their check label
+			if metric.MetricName != "" {
+				return fmt.Errorf("metric %s is a check, which is always exposed as %s, so it can't have a metric_name", metric.Name, checkMetricName)
+			}
+			metric.check, metric.Type, metric.MetricName = true, "gauge", checkMetricName
+			metric.Labels = maps.Clone(metric.Labels)
+			if metric.Labels == nil {
+				metric.Labels = make(map[string]string)
+			}
+			metric.Labels[checkLabel] = metric.Name
+		}
+		if metric.MetricName == "" {
+			metric.MetricName = metric.Name
+		}
+		if sanitized := sanitizeMetricName(metric.MetricName); sanitized != metric.MetricName {
+			log.Printf("Warning: metric name %q is invalid, exposing it as %q", metric.MetricName, sanitized)
+			metric.MetricName = sanitized
+		}
+		if metric.Type == "" {
+			metric.Type = "gauge"
+			if len(metric.HistogramBuckets) > 0 {
+				metric.Type = "histogram"
+			}
+		}
+		if metric.Type == "counter" && !strings.HasSuffix(metric.MetricName, "_total") {
+			log.Printf("Warning: counter %s should be named with a _total suffix", metric.MetricName)
+		}
+		if metric.Unit != "" && !hasUnitSuffix(metric.MetricName, metric.Unit) {
+			log.Printf("Warning: ignoring unit %q of metric %s, its name must end in _%s", metric.Unit, metric.MetricName, metric.Unit)
+			metric.Unit = ""
+		}
+		for i, col := range metric.ValueColumns {
+			name := metric.MetricName + "_" + col.Column
+			if col.Type == "counter" && !strings.HasSuffix(name, "_total") {
+				log.Printf("Warning: counter %s should be named with a _total suffix", name)
+			}
+			if col.Unit != "" && !hasUnitSuffix(name, col.Unit) {
+				log.Printf("Warning: ignoring unit %q of metric %s, its name must end in _%s", col.Unit, name, col.Unit)
+				metric.ValueColumns[i].Unit = ""
+			}
+		}
+
+		// Problems name the metric, by position if it has no name
+		field := "metric " + metric.Name + ": "
+		if metric.Name == "" {
+			field = fmt.Sprintf("metric #%d: ", i+1)
+		}
+		if interval, ok := config.parsePositiveDuration(field+"interval", jsonMetric.Interval); ok {
+			metric.Interval = interval
+		} else {
+			// Default to the global interval
+			metric.Interval = config.Interval
+		}
+
+		if jsonMetric.Timeout == "auto" {
+			metric.AutoTimeout = true
+		} else if timeout, ok := config.parsePositiveDuration(field+"timeout", jsonMetric.Timeout); ok {
+			metric.Timeout = timeout
+		}
+
+		if staleAfter, ok := config.parseDuration(field+"stale_after", jsonMetric.StaleAfter); ok {
+			metric.StaleAfter = staleAfter
+		}
+
+		if phase, ok := config.parseDuration(field+"phase", jsonMetric.Phase); ok {
+			metric.Phase = phase
+		}
+
+		if interval, ok := config.parsePositiveDuration(field+"metadata_interval", jsonMetric.MetadataInterval); ok {
+			metric.MetadataInterval = interval
+		} else {
+			// Metadata changes rarely, so refresh it far less often than values
+			metric.MetadataInterval = 10 * metric.Interval
+		}
+
+		config.Metrics = append(config.Metrics, metric)
+	}
+
+	return nil
+}
+
+// unknownFields returns the paths of the keys in a decoded JSON value that
+// don't correspond to a field of t. Keys are matched case-insensitively, as
+// encoding/json does.
+func unknownFields(data interface{}, t reflect.Type, path string) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	var unknown []string
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := data.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+
+		fields := make(map[string]reflect.Type)
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			fields[strings.ToLower(name)] = field.Type
+		}
+
+		for key, value := range obj {
+			keyPath := key
+			if path != "" {
+				keyPath = path + "." + key
+			}
+
+			fieldType, ok := fields[strings.ToLower(key)]
+			if !ok {
+				unknown = append(unknown, keyPath)
+				continue
+			}
+			unknown = append(unknown, unknownFields(value, fieldType, keyPath)...)
+		}
+	case reflect.Slice, reflect.Array:
+		arr, ok := data.([]interface{})
+		if !ok {
+			return nil
+		}
+		for i, elem := range arr {
+			unknown = append(unknown, unknownFields(elem, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case reflect.Map:
+		obj, ok := data.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		for key, value := range obj {
+			unknown = append(unknown, unknownFields(value, t.Elem(), path+"."+key)...)
+		}
+	}
+
+	sort.Strings(unknown)
+	return unknown
+}
+
+// maxConfigSize bounds the size of a config fetched from a URL
+const maxConfigSize = 10 << 20
+
+// configClient fetches configs from URLs
+var configClient = &http.Client{Timeout: 30 * time.Second}
+
+// isConfigURL reports whether the config path is an HTTP(S) URL
+func isConfigURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// fetchConfig downloads the config at url, returning it with its ETag. Given
+// the ETag of the config fetched last it returns no data if the server
+// reports the config unchanged.
+func fetchConfig(ctx context.Context, url, etag string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	resp, err := configClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && etag != "" {
+		return nil, etag, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("config server returned %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxConfigSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(data) > maxConfigSize {
+		return nil, "", fmt.Errorf("config is larger than %d bytes", maxConfigSize)
+	}
+	return data, resp.Header.Get("ETag"), nil
+}
+
+// watchConfigURL fetches the config from url every interval and reloads the
+// app when it changed, detected by the server's ETag or else by comparing the
+// content. A config that can't be fetched or loaded leaves the last good one
+// running.
+func (a *App) watchConfigURL(ctx context.Context, url string, interval time.Duration, strict bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// Start from the config the app was loaded with, so the first fetch
+	// doesn't reload it unchanged
+	a.metricsMux.RLock()
+	etag, sum := a.config.etag, a.config.checksum
+	a.metricsMux.RUnlock()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		data, newETag, err := fetchConfig(ctx, url, etag)
+		if err != nil {
+			log.Printf("Error fetching config, keeping the current one: %v", err)
+			continue
+		}
+		if data == nil || sha256.Sum256(data) == sum {
+			continue
+		}
+
+		config, err := parseConfig(bytes.NewReader(data), "config from "+url, configFormat(url), strict)
+		if err == nil {
+			err = config.Validate()
+		}
+		if err == nil {
+			err = a.Reload(config)
+		}
+		if err != nil {
+			log.Printf("Error loading config, keeping the current one: %v", err)
+			continue
+		}
+		etag, sum = newETag, sha256.Sum256(data)
+	}
+}
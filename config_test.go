@@ -0,0 +1,746 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   []string
+	}{
+		{
+			name:   "valid",
+			config: `{"database": {"driver": "mock"}, "metrics": [{"name": "a", "query": "SELECT 1 AS value"}, {"name": "b", "query": "SELECT 2 AS value"}]}`,
+		},
+		{
+			name:   "port out of range",
+			config: `{"database": {"driver": "mock"}, "port": 70000, "metrics": []}`,
+			want:   []string{"port 70000 is not between 0 and 65535"},
+		},
+		{
+			name:   "no name",
+			config: `{"database": {"driver": "mock"}, "metrics": [{"name": "a", "query": "SELECT 1 AS value"}, {"query": "SELECT 2 AS value"}]}`,
+			want:   []string{"metric #2 has no name"},
+		},
+		{
+			name:   "duplicate name",
+			config: `{"database": {"driver": "mock"}, "metrics": [{"name": "a", "query": "SELECT 1 AS value"}, {"name": "a", "query": "SELECT 2 AS value"}]}`,
+			want:   []string{"metric name a is used more than once"},
+		},
+		{
+			name:   "empty query",
+			config: `{"database": {"driver": "mock"}, "metrics": [{"name": "a", "query": "  "}]}`,
+			want:   []string{"metric a has no query"},
+		},
+		{
+			name:   "invalid duration",
+			config: `{"database": {"driver": "mock"}, "metrics": [{"name": "a", "query": "SELECT 1 AS value", "stale_after": "5 minutes"}]}`,
+			want:   []string{`metric a: stale_after: invalid duration "5 minutes"`},
+		},
+		{
+			name:   "family type mismatch",
+			config: `{"database": {"driver": "mock"}, "metrics": [{"name": "a", "metric_name": "queue_depth", "query": "SELECT 1 AS value"}, {"name": "b", "metric_name": "queue_depth", "type": "counter", "query": "SELECT 2 AS value"}]}`,
+			want:   []string{`metrics a and b both expose queue_depth, but with type "gauge" and "counter"`},
+		},
+		{
+			name:   "family unit mismatch",
+			config: `{"database": {"driver": "mock"}, "metrics": [{"name": "a", "metric_name": "queue_bytes", "unit": "bytes", "query": "SELECT 1 AS value"}, {"name": "b", "metric_name": "queue_bytes", "query": "SELECT 2 AS value"}]}`,
+			want:   []string{`metrics a and b both expose queue_bytes, but with unit "bytes" and ""`},
+		},
+		{
+			name:   "family help mismatch",
+			config: `{"database": {"driver": "mock"}, "metrics": [{"name": "a", "metric_name": "jobs", "query": "SELECT 1 AS done", "value_columns": [{"column": "done", "help": "Jobs done"}]}, {"name": "b", "metric_name": "jobs", "query": "SELECT 2 AS done", "value_columns": ["done"]}]}`,
+			want:   []string{`metrics a and b both expose jobs_done, but with help "Jobs done" and ""`},
+		},
+		{
+			name:   "compatible family",
+			config: `{"database": {"driver": "mock"}, "metrics": [{"name": "a", "metric_name": "queue_depth", "query": "SELECT 1 AS value"}, {"name": "b", "metric_name": "queue_depth", "type": "gauge", "query": "SELECT 2 AS value"}]}`,
+		},
+		{
+			name:   "every problem",
+			config: `{"database": {"driver": "mock"}, "port": -1, "interval": "soon", "metrics": [{"name": "a", "query": ""}, {"name": "a", "query": "SELECT 1 AS value"}]}`,
+			want: []string{
+				`interval: invalid duration "soon"`,
+				"port -1 is not between 0 and 65535",
+				"metric a has no query",
+				"metric name a is used more than once",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := parseConfig(strings.NewReader(tt.config), "test config", configFormatJSON, false)
+			if err != nil {
+				t.Fatalf("parseConfig() error = %v", err)
+			}
+			err = config.Validate()
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Errorf("Validate() error = %v, want none", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Validate() error = nil, want %q", tt.want)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Validate() error = %v, want it to contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateDurations(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   string
+	}{
+		{
+			name:   "valid",
+			config: `{"database": {"driver": "mock"}, "interval": "30s", "metrics": [{"name": "m", "query": "SELECT 1 AS value", "interval": "10s", "timeout": "5s"}]}`,
+		},
+		{
+			name:   "zero global interval",
+			config: `{"database": {"driver": "mock"}, "interval": "0s", "metrics": []}`,
+			want:   "interval: duration 0s is not positive",
+		},
+		{
+			name:   "negative global interval",
+			config: `{"database": {"driver": "mock"}, "interval": "-1m", "metrics": []}`,
+			want:   "interval: duration -1m is not positive",
+		},
+		{
+			name:   "zero metric interval",
+			config: `{"database": {"driver": "mock"}, "metrics": [{"name": "m", "query": "SELECT 1 AS value", "interval": "0s"}]}`,
+			want:   "metric m: interval: duration 0s is not positive",
+		},
+		{
+			name:   "negative metric timeout",
+			config: `{"database": {"driver": "mock"}, "metrics": [{"name": "m", "query": "SELECT 1 AS value", "timeout": "-5s"}]}`,
+			want:   "metric m: timeout: duration -5s is not positive",
+		},
+		{
+			name:   "zero metadata interval",
+			config: `{"database": {"driver": "mock"}, "metrics": [{"name": "m", "query": "SELECT 1 AS value", "metadata_interval": "0s"}]}`,
+			want:   "metric m: metadata_interval: duration 0s is not positive",
+		},
+		{
+			name:   "zero probe timeout",
+			config: `{"database": {"driver": "mock"}, "probe": {"timeout": "0s"}, "metrics": []}`,
+			want:   "probe.timeout: duration 0s is not positive",
+		},
+		{
+			name:   "negative push interval",
+			config: `{"database": {"driver": "mock"}, "push": {"interval": "-10s"}, "metrics": []}`,
+			want:   "push.interval: duration -10s is not positive",
+		},
+		{
+			name:   "zero health check timeout",
+			config: `{"database": {"driver": "mock"}, "health_check": {"timeout": "0s"}, "metrics": []}`,
+			want:   "health_check.timeout: duration 0s is not positive",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := parseConfig(strings.NewReader(tt.config), "test config", configFormatJSON, false)
+			if err != nil {
+				t.Fatalf("parseConfig() error = %v", err)
+			}
+			err = config.Validate()
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("Validate() error = %v, want none", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Validate() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateBuiltConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		want   string
+	}{
+		{
+			name:   "zero interval",
+			config: Config{Port: 8080},
+			want:   "interval 0s is not positive",
+		},
+		{
+			name: "zero metric interval",
+			config: Config{Port: 8080, Interval: time.Minute, Metrics: []MetricConfig{
+				{Name: "m", Query: "SELECT 1"},
+			}},
+			want: "metric m has interval 0s, which is not positive",
+		},
+		{
+			name: "negative metric timeout",
+			config: Config{Port: 8080, Interval: time.Minute, Metrics: []MetricConfig{
+				{Name: "m", Query: "SELECT 1", Interval: time.Minute, Timeout: -time.Second},
+			}},
+			want: "metric m has timeout -1s, which is not positive",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Validate() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateMaskSecret(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   string
+	}{
+		{
+			name:   "hash without secret",
+			config: `{"database": {"driver": "mock"}, "metrics": [{"name": "m", "query": "SELECT email, 1 AS value", "mask_labels": ["email"]}]}`,
+			want:   "metric m masks labels in hash mode, which needs mask_secret",
+		},
+		{
+			name:   "hash with secret",
+			config: `{"database": {"driver": "mock"}, "mask_secret": "s3cret", "metrics": [{"name": "m", "query": "SELECT email, 1 AS value", "mask_labels": ["email"]}]}`,
+		},
+		{
+			name:   "placeholder without secret",
+			config: `{"database": {"driver": "mock"}, "metrics": [{"name": "m", "query": "SELECT email, 1 AS value", "mask_labels": ["email"], "mask_mode": "placeholder"}]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := parseConfig(strings.NewReader(tt.config), "test config", configFormatJSON, false)
+			if err != nil {
+				t.Fatalf("parseConfig() error = %v", err)
+			}
+			err = config.Validate()
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("Validate() error = %v, want none", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Validate() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnknownFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   []string
+	}{
+		{
+			name:   "known",
+			config: `{"port": 9090, "database": {"driver": "mysql"}, "metrics": [{"name": "m", "query": "SELECT 1"}]}`,
+		},
+		{
+			name:   "top level",
+			config: `{"port": 9090, "intervall": "30s"}`,
+			want:   []string{"intervall"},
+		},
+		{
+			name:   "case insensitive",
+			config: `{"Port": 9090, "DATABASE": {"Driver": "mysql"}}`,
+		},
+		{
+			name:   "nested",
+			config: `{"database": {"driver": "mysql", "pool": 5}, "circuit_breaker": {"retry": 2}}`,
+			want:   []string{"circuit_breaker.retry", "database.pool"},
+		},
+		{
+			name:   "metric",
+			config: `{"metrics": [{"name": "a"}, {"name": "b", "querry": "SELECT 1", "lables": {}}]}`,
+			want:   []string{"metrics[1].lables", "metrics[1].querry"},
+		},
+		{
+			name:   "map values",
+			config: `{"databases": {"replica": {"dsn": "x", "drvier": "mysql"}}}`,
+			want:   []string{"databases.replica.drvier"},
+		},
+		{
+			name:   "value column shorthand",
+			config: `{"metrics": [{"name": "m", "value_columns": ["a", {"column": "b", "hlep": "x"}]}]}`,
+			want:   []string{"metrics[0].value_columns[1].hlep"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var raw interface{}
+			if err := json.Unmarshal([]byte(tt.config), &raw); err != nil {
+				t.Fatalf("json.Unmarshal() error = %v", err)
+			}
+			got := unknownFields(raw, reflect.TypeOf(jsonConfig{}), "")
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unknownFields() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWatchConfigURL(t *testing.T) {
+	for _, useETag := range []bool{false, true} {
+		t.Run(fmt.Sprintf("etag=%v", useETag), func(t *testing.T) {
+			var mu sync.Mutex
+			body := `{"database": {"driver": "mock"}, "metrics": [{"name": "a", "query": "SELECT 1 AS value"}]}`
+			var fetches, served int
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				fetches++
+				if useETag {
+					sum := sha256.Sum256([]byte(body))
+					etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+					w.Header().Set("ETag", etag)
+					if r.Header.Get("If-None-Match") == etag {
+						w.WriteHeader(http.StatusNotModified)
+						return
+					}
+				}
+				served++
+				io.WriteString(w, body)
+			}))
+			defer server.Close()
+
+			config, err := LoadConfig(server.URL, false)
+			if err != nil {
+				t.Fatalf("LoadConfig() error = %v", err)
+			}
+			app, err := NewApp(config)
+			if err != nil {
+				t.Fatalf("NewApp() error = %v", err)
+			}
+			logs := captureLog(t)
+
+			// Reloads start collectors under the context Start would set
+			ctx, cancel := context.WithCancel(context.Background())
+			app.ctx = ctx
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				app.watchConfigURL(ctx, server.URL, 10*time.Millisecond, false)
+			}()
+			defer func() {
+				cancel()
+				<-done
+				app.Shutdown(context.Background())
+			}()
+
+			waitFor := func(what string, cond func() bool) {
+				t.Helper()
+				deadline := time.Now().Add(5 * time.Second)
+				for !cond() {
+					if time.Now().After(deadline) {
+						t.Fatalf("timed out waiting for %s", what)
+					}
+					time.Sleep(5 * time.Millisecond)
+				}
+			}
+
+			waitFor("polls", func() bool {
+				mu.Lock()
+				defer mu.Unlock()
+				return fetches >= 4
+			})
+			if strings.Contains(logs.String(), "Reloaded config") {
+				t.Errorf("unchanged config was reloaded:\n%s", logs)
+			}
+			if useETag {
+				mu.Lock()
+				if served != 1 {
+					t.Errorf("server sent the config %d times, want only at startup", served)
+				}
+				mu.Unlock()
+			}
+
+			mu.Lock()
+			body = `{"database": {"driver": "mock"}, "metrics": [{"name": "a", "query": "SELECT 1 AS value"}, {"name": "b", "query": "SELECT 2 AS value"}]}`
+			mu.Unlock()
+			waitFor("reload", func() bool {
+				app.metricsMux.RLock()
+				defer app.metricsMux.RUnlock()
+				return len(app.config.Metrics) == 2
+			})
+			if got := strings.Count(logs.String(), "Reloaded config"); got != 1 {
+				t.Errorf("config reloaded %d times, want once:\n%s", got, logs)
+			}
+		})
+	}
+}
+
+// clearConfigEnv unsets the environment variables that configure the
+// exporter for the rest of the test
+func clearConfigEnv(t *testing.T) {
+	t.Helper()
+	for _, name := range append([]string{"CONFIG_JSON"}, envOverrides...) {
+		t.Setenv(name, "")
+	}
+}
+
+func TestConfigJSONEnv(t *testing.T) {
+	clearConfigEnv(t)
+	t.Setenv("CONFIG_JSON", `{"port": 9100, "database": {"driver": "mock"}, "metrics": [{"name": "up", "query": "SELECT 1 AS value"}]}`)
+
+	config, err := LoadConfig("", false)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if config.Port != 9100 || len(config.Metrics) != 1 || config.Metrics[0].Name != "up" {
+		t.Errorf("LoadConfig() = port %d, metrics %+v, want the config from CONFIG_JSON", config.Port, config.Metrics)
+	}
+
+	// The other variables still override it
+	t.Setenv("PORT", "9200")
+	if config, err = LoadConfig("", false); err != nil || config.Port != 9200 {
+		t.Errorf("LoadConfig() with PORT = port %d, error %v, want port 9200", config.Port, err)
+	}
+
+	// A config file takes precedence
+	file := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(file, []byte(`{"database": {"driver": "mock"}, "metrics": []}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if config, err = LoadConfig(file, false); err != nil || len(config.Metrics) != 0 {
+		t.Errorf("LoadConfig(file) = metrics %+v, error %v, want the file's config", config.Metrics, err)
+	}
+
+	t.Setenv("CONFIG_JSON", `{"port": `)
+	if _, err := LoadConfig("", false); err == nil || !strings.Contains(err.Error(), "CONFIG_JSON") {
+		t.Errorf("LoadConfig() with invalid CONFIG_JSON error = %v, want it to name CONFIG_JSON", err)
+	}
+}
+
+func TestStrictConfig(t *testing.T) {
+	const unknown = `"intervl": "30s", "metrics": [{"name": "m", "querry": "SELECT 1"}]`
+	tests := []struct {
+		name    string
+		config  string
+		strict  bool
+		wantErr bool
+	}{
+		{name: "lenient", config: `{"database": {"driver": "mock"}, ` + unknown + `}`},
+		{name: "strict flag", config: `{"database": {"driver": "mock"}, ` + unknown + `}`, strict: true, wantErr: true},
+		{name: "strict field", config: `{"strict": true, "database": {"driver": "mock"}, ` + unknown + `}`, wantErr: true},
+		{name: "strict without unknown fields", config: `{"strict": true, "database": {"driver": "mock"}, "metrics": []}`, strict: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			_, err := parseConfig(strings.NewReader(tt.config), "test config", configFormatJSON, tt.strict)
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("parseConfig() error = %v, want none", err)
+				}
+				if strings.Contains(tt.config, "intervl") && !strings.Contains(logs.String(), "intervl") {
+					t.Errorf("unknown fields weren't logged:\n%s", logs)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("parseConfig() error = nil, want the unknown fields")
+			}
+			for _, field := range []string{"intervl", "metrics[0].querry"} {
+				if !strings.Contains(err.Error(), field) {
+					t.Errorf("parseConfig() error = %v, want it to list %s", err, field)
+				}
+			}
+		})
+	}
+}
+
+func TestDependencyOrders(t *testing.T) {
+	metric := func(name string, deps ...string) MetricConfig {
+		return MetricConfig{Name: name, DependsOn: deps}
+	}
+	names := func(order []MetricConfig) string {
+		var names []string
+		for _, m := range order {
+			names = append(names, m.Name)
+		}
+		return strings.Join(names, " ")
+	}
+
+	orders, err := dependencyOrders([]MetricConfig{
+		metric("report", "summary", "totals"),
+		metric("summary", "refresh"),
+		metric("totals", "refresh"),
+		metric("refresh"),
+	})
+	if err != nil {
+		t.Fatalf("dependencyOrders() error = %v", err)
+	}
+	want := map[string]string{
+		"report":  "refresh summary totals report",
+		"summary": "refresh summary",
+		"totals":  "refresh totals",
+		"refresh": "refresh",
+	}
+	for name, wantOrder := range want {
+		if got := names(orders[name]); got != wantOrder {
+			t.Errorf("order of %s = %q, want %q", name, got, wantOrder)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		metrics []MetricConfig
+		want    string
+	}{
+		{name: "unknown", metrics: []MetricConfig{metric("a", "missing")}, want: "metric a depends on unknown metric missing"},
+		{name: "self", metrics: []MetricConfig{metric("a", "a")}, want: "dependency cycle a -> a"},
+		{name: "cycle", metrics: []MetricConfig{metric("a", "b"), metric("b", "c"), metric("c", "a")}, want: "dependency cycle a -> b -> c -> a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := dependencyOrders(tt.metrics); err == nil || err.Error() != tt.want {
+				t.Errorf("dependencyOrders() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestGzippedConfig(t *testing.T) {
+	clearConfigEnv(t)
+
+	gzipped := func(config string) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write([]byte(config))
+		zw.Close()
+		return buf.Bytes()
+	}
+	const jsonConfig = `{"database": {"driver": "mock"}, "metrics": [{"name": "up", "query": "SELECT 1 AS value"}]}`
+	const yamlConfig = "database:\n  driver: mock\nmetrics:\n  - name: up\n    query: SELECT 1 AS value\n"
+
+	tests := []struct {
+		name string
+		file string
+		data []byte
+	}{
+		{name: "json", file: "config.json.gz", data: gzipped(jsonConfig)},
+		{name: "yaml", file: "config.yaml.gz", data: gzipped(yamlConfig)},
+		// Detected by its magic bytes, not the extension
+		{name: "no extension", file: "config.json", data: gzipped(jsonConfig)},
+		{name: "plain", file: "config.json", data: []byte(jsonConfig)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, tt.data, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			config, err := LoadConfig(path, false)
+			if err != nil {
+				t.Fatalf("LoadConfig() error = %v", err)
+			}
+			if len(config.Metrics) != 1 || config.Metrics[0].Name != "up" {
+				t.Errorf("LoadConfig() metrics = %+v, want up", config.Metrics)
+			}
+		})
+	}
+
+	// A truncated gzip stream is an error rather than a partial config
+	path := filepath.Join(t.TempDir(), "config.json.gz")
+	data := gzipped(jsonConfig)
+	if err := os.WriteFile(path, data[:len(data)/2], 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(path, false); err == nil {
+		t.Error("LoadConfig() of a truncated gzipped config succeeded")
+	}
+}
+
+func TestYAMLConfig(t *testing.T) {
+	clearConfigEnv(t)
+
+	const jsonConfig = `{
+		"port": 9100,
+		"interval": "30s",
+		"database": {"driver": "mock", "max_open": 4},
+		"circuit_breaker": {"threshold": 3, "max_backoff": "5m"},
+		"metrics": [
+			{"name": "users_total", "query": "SELECT COUNT(*) FROM users", "scalar": true, "type": "counter"},
+			{"name": "order_amount", "query": "SELECT region, min, max FROM orders", "interval": "1m", "value_columns": ["min", {"column": "max", "help": "Largest order"}], "labels": {"team": "sales"}}
+		]
+	}`
+	const yamlConfig = `
+port: 9100
+interval: 30s
+database:
+  driver: mock
+  max_open: 4
+circuit_breaker:
+  threshold: 3
+  max_backoff: 5m
+metrics:
+  - name: users_total
+    query: SELECT COUNT(*) FROM users
+    scalar: true
+    type: counter
+  - name: order_amount
+    query: SELECT region, min, max FROM orders
+    interval: 1m
+    value_columns:
+      - min
+      - column: max
+        help: Largest order
+    labels:
+      team: sales
+`
+
+	dir := t.TempDir()
+	load := func(name, data string) Config {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		config, err := LoadConfig(path, true)
+		if err != nil {
+			t.Fatalf("LoadConfig(%s) error = %v", name, err)
+		}
+		return config
+	}
+
+	want := load("config.json", jsonConfig)
+	for _, name := range []string{"config.yaml", "config.yml"} {
+		if got := load(name, yamlConfig); !reflect.DeepEqual(got, want) {
+			t.Errorf("LoadConfig(%s) = %+v, want the same as the JSON config %+v", name, got, want)
+		}
+	}
+
+	// Unknown extensions are JSON, and strict mode checks YAML fields too
+	if got := load("config.conf", jsonConfig); !reflect.DeepEqual(got, want) {
+		t.Errorf("LoadConfig(config.conf) = %+v, want it read as JSON", got)
+	}
+	path := filepath.Join(dir, "typo.yaml")
+	if err := os.WriteFile(path, []byte("database:\n  driver: mock\nintervl: 30s\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(path, true); err == nil || !strings.Contains(err.Error(), "intervl") {
+		t.Errorf("LoadConfig() of a YAML config with an unknown field error = %v, want it listed", err)
+	}
+}
+
+func TestEnvOverrides(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings string
+		wantPort int
+		wantDSN  string
+	}{
+		{name: "default", wantPort: 9100, wantDSN: "from-env"},
+		{name: "disabled", settings: `"allow_env_overrides": false,`, wantPort: 8080, wantDSN: "from-file"},
+		{name: "allowlisted", settings: `"env_overrides": ["DB_DSN"],`, wantPort: 8080, wantDSN: "from-env"},
+		{name: "allowlist ignored when disabled", settings: `"allow_env_overrides": false, "env_overrides": ["DB_DSN"],`, wantPort: 8080, wantDSN: "from-file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearConfigEnv(t)
+			t.Setenv("PORT", "9100")
+			t.Setenv("DB_DSN", "from-env")
+
+			config, err := parseConfig(strings.NewReader(`{`+tt.settings+`
+				"port": 8080,
+				"database": {"driver": "mock", "dsn": "from-file"}
+			}`), "test config", configFormatJSON, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.Port != tt.wantPort || config.Database.DSN != tt.wantDSN {
+				t.Errorf("port = %d, dsn = %q, want %d and %q", config.Port, config.Database.DSN, tt.wantPort, tt.wantDSN)
+			}
+		})
+	}
+
+	clearConfigEnv(t)
+	_, err := parseConfig(strings.NewReader(`{"env_overrides": ["DB_PASSWORD"], "database": {"driver": "mock"}}`), "test config", configFormatJSON, false)
+	if err == nil || !strings.Contains(err.Error(), "env_overrides lists unknown variable DB_PASSWORD") {
+		t.Errorf("parseConfig() error = %v, want the unknown variable", err)
+	}
+}
+
+func TestDSNExpansion(t *testing.T) {
+	clearConfigEnv(t)
+	t.Setenv("TEST_DB_PASSWORD", "pa$$word")
+	t.Setenv("TEST_DB_HOST", "db")
+
+	config, err := parseConfig(strings.NewReader(`{
+		"database": {"driver": "mock", "dsn": "exporter:${TEST_DB_PASSWORD}@tcp(${TEST_DB_HOST}:3306)/app"},
+		"databases": {
+			"literal": {"driver": "mock", "dsn": "user:pa$word@tcp($${TEST_DB_HOST})/$TEST_DB_HOST"}
+		},
+		"mask_secret": "${TEST_DB_PASSWORD}",
+		"metrics": [{"name": "up", "query": "SELECT '${TEST_DB_HOST}' AS host, 1 AS value"}]
+	}`), "test config", configFormatJSON, false)
+	if err != nil {
+		t.Fatalf("parseConfig() error = %v", err)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+
+	if want := "exporter:pa$$word@tcp(db:3306)/app"; config.Database.DSN != want {
+		t.Errorf("database.dsn = %q, want %q", config.Database.DSN, want)
+	}
+	// A bare $ is kept and $${ escapes a literal ${
+	if want := "user:pa$word@tcp(${TEST_DB_HOST})/$TEST_DB_HOST"; config.Databases["literal"].DSN != want {
+		t.Errorf("databases.literal.dsn = %q, want %q", config.Databases["literal"].DSN, want)
+	}
+	if config.MaskSecret != "pa$$word" {
+		t.Errorf("mask_secret = %q, want it expanded", config.MaskSecret)
+	}
+	if want := "SELECT '${TEST_DB_HOST}' AS host, 1 AS value"; config.Metrics[0].Query != want {
+		t.Errorf("query = %q, want it left unexpanded", config.Metrics[0].Query)
+	}
+
+	// An unset variable fails validation rather than leaving an empty password
+	t.Setenv("TEST_DB_PASSWORD", "")
+	os.Unsetenv("TEST_DB_PASSWORD")
+	config, err = parseConfig(strings.NewReader(`{"database": {"driver": "mock", "dsn": "exporter:${TEST_DB_PASSWORD}@tcp(db)/app"}}`), "test config", configFormatJSON, false)
+	if err != nil {
+		t.Fatalf("parseConfig() error = %v", err)
+	}
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "database.dsn: environment variable TEST_DB_PASSWORD is not set") {
+		t.Errorf("Validate() error = %v, want the unset variable", err)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+// applyDelta replaces the values of a delta metric's series with their change
+// since its previous collection, matching series by their identity. A series
+// seen for the first time has no change yet and is left out until the next
+// collection, and the values of series that disappeared are forgotten. A value
+// lower than before is taken to be a counter reset, the change being the new
+// value. Must be called with metricsMux held.
+func (a *App) applyDelta(metric MetricConfig, series map[string]timeSeries) map[string]timeSeries {
+	stats := a.stats[metric.Name]
+
+	current := make(map[string]float64, len(series))
+	deltas := make(map[string]timeSeries, len(series))
+	for key, s := range series {
+		value, ok := toFloat64(s.value)
+		if !ok {
+			continue
+		}
+		current[key] = value
+
+		previous, ok := stats.previous[key]
+		if !ok {
+			continue
+		}
+		delta := value - previous
+		if delta < 0 {
+			delta = value
+		}
+		s.value = delta
+		deltas[key] = s
+	}
+
+	stats.previous = current
+	return deltas
+}
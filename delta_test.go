@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestDelta(t *testing.T) {
+	app := newTestApp(t, `{
+		"database": {"driver": "mock", "mock": [
+			{"query": "SELECT region, value FROM orders_1", "columns": ["region", "value"], "rows": [["eu", 10], ["us", 5]]},
+			{"query": "SELECT region, value FROM orders_2", "columns": ["region", "value"], "rows": [["eu", 15], ["apac", 3]]},
+			{"query": "SELECT region, value FROM orders_3", "columns": ["region", "value"], "rows": [["eu", 2], ["us", 7], ["apac", 4]]}
+		]},
+		"metrics": [{"name": "orders", "query": "SELECT region, value FROM orders_1", "delta": true}]
+	}`)
+	metric := app.config.Metrics[0]
+
+	// collect runs the metric's query on the next cycle's rows
+	collect := func(cycle string) string {
+		t.Helper()
+		metric.Query = "SELECT region, value FROM orders_" + cycle
+		if err := app.runQuery(context.Background(), metric); err != nil {
+			t.Fatal(err)
+		}
+		return "\n" + scrape(t, app, "/metrics")
+	}
+
+	// The first collection has no changes to report yet
+	body := "\n" + scrape(t, app, "/metrics")
+	if strings.Contains(body, "\norders{") {
+		t.Errorf("/metrics after the first collection has deltas:\n%s", body)
+	}
+
+	// New series wait for the next collection and disappeared ones are dropped
+	body = collect("2")
+	wantLines(t, body, `orders{region="eu"} 5`)
+	for _, unwanted := range []string{`orders{region="us"}`, `orders{region="apac"}`} {
+		if strings.Contains(body, "\n"+unwanted) {
+			t.Errorf("/metrics has %s:\n%s", unwanted, body)
+		}
+	}
+
+	// A lower value is a counter reset, and a series that came back is new
+	body = collect("3")
+	wantLines(t, body, `orders{region="eu"} 2`, `orders{region="apac"} 1`)
+	if strings.Contains(body, "\n"+`orders{region="us"}`) {
+		t.Errorf("/metrics has a delta for a series that disappeared in between:\n%s", body)
+	}
+}
+
+func TestDeltaConfig(t *testing.T) {
+	for _, conflict := range []string{`"on_scrape": true`, `"histogram_buckets": [10]`} {
+		_, err := parseConfig(strings.NewReader(`{
+			"database": {"driver": "mock"},
+			"metrics": [{"name": "m", "query": "SELECT 1 AS value", "delta": true, `+conflict+`}]
+		}`), "test config", configFormatJSON, false)
+		want := "metric m is a delta, which isn't supported for on-scrape metrics, histograms and summaries"
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("delta with %s: parseConfig() error = %v, want %q", conflict, err, want)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// dumpExposition logs the exposition a scraper of /metrics would receive,
+// leaving out on-scrape metrics as they only run for a request
+func (a *App) dumpExposition() {
+	var buf bytes.Buffer
+	a.metricsMux.RLock()
+	a.writeSeries(&buf, a.currentSeries(outputScrape), false)
+	a.writeSelfMetrics(&buf, false)
+	a.metricsMux.RUnlock()
+
+	log.Printf("Exposition:\n%s", buf.String())
+}
+
+// watchDumpSignal logs the exposition every time the process receives
+// SIGUSR2, until ctx is done
+func (a *App) watchDumpSignal(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case <-signals:
+			a.dumpExposition()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDumpExposition(t *testing.T) {
+	logs := captureLog(t)
+	app := newTestApp(t, `{
+		"database": {"driver": "mock", "mock": [{"query": "SELECT region, value FROM sales", "columns": ["region", "value"], "rows": [["eu", 3]]}]},
+		"metrics": [
+			{"name": "sales", "query": "SELECT region, value FROM sales"},
+			{"name": "sales_by_param", "query": "SELECT region, value FROM sales", "on_scrape": true}
+		]
+	}`)
+
+	// Keep SIGUSR2 from killing the test before the watcher is notified
+	caught := make(chan os.Signal, 1)
+	signal.Notify(caught, syscall.SIGUSR2)
+	defer signal.Stop(caught)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		app.watchDumpSignal(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// The watcher may not be listening yet, so signal until it logs
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(logs.String(), "Exposition:") && time.Now().Before(deadline) {
+		syscall.Kill(os.Getpid(), syscall.SIGUSR2)
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	dump := logs.String()
+	if !strings.Contains(dump, "Exposition:") {
+		t.Fatalf("SIGUSR2 didn't log the exposition:\n%s", dump)
+	}
+	// It is what a scraper would receive, apart from on-scrape metrics
+	for _, want := range []string{"# TYPE sales gauge\n", "\nsales{region=\"eu\"} 3\n", "\n# TYPE sqlmetrics_query_errors_total counter\n"} {
+		if !strings.Contains(dump, want) {
+			t.Errorf("logged exposition doesn't contain %q:\n%s", want, dump)
+		}
+	}
+	if strings.Contains(dump, "\nsales_by_param") {
+		t.Errorf("logged exposition contains an on-scrape metric:\n%s", dump)
+	}
+}
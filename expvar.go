@@ -0,0 +1,86 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// expvarApp is the App whose values the expvars report
+	expvarApp atomic.Pointer[App]
+
+	// publishOnce guards the expvars, whose names are global and may only
+	// be published once per process
+	publishOnce sync.Once
+)
+
+// publishExpvars publishes the collection counters and the last values of
+// the metrics with the expvar package, for tooling reading /debug/vars.
+// expvar names are global, so the App publishing last is the one reported.
+func (a *App) publishExpvars() {
+	expvarApp.Store(a)
+	publishOnce.Do(publishAppExpvars)
+}
+
+// publishAppExpvars publishes the expvars reporting on expvarApp
+func publishAppExpvars() {
+	expvar.Publish("sqlmetrics_collections", expvar.Func(func() interface{} {
+		a := expvarApp.Load()
+		a.metricsMux.RLock()
+		defer a.metricsMux.RUnlock()
+
+		total := 0
+		for _, metric := range a.config.Metrics {
+			total += a.stats[metric.Name].collections
+		}
+		return total
+	}))
+
+	expvar.Publish("sqlmetrics_errors", expvar.Func(func() interface{} {
+		a := expvarApp.Load()
+		a.metricsMux.RLock()
+		defer a.metricsMux.RUnlock()
+
+		total := 0
+		for _, metric := range a.config.Metrics {
+			total += a.stats[metric.Name].errors
+		}
+		return total
+	}))
+
+	// Each metric's values are keyed by series as they are exposed, e.g.
+	// orders_total{region="eu"}
+	expvar.Publish("sqlmetrics_last_values", expvar.Func(func() interface{} {
+		a := expvarApp.Load()
+		a.metricsMux.RLock()
+		defer a.metricsMux.RUnlock()
+
+		values := make(map[string]map[string]float64, len(a.metrics))
+		for name, metricSeries := range a.metrics {
+			values[name] = make(map[string]float64, len(metricSeries))
+			for _, s := range metricSeries {
+				f, ok := toFloat64(s.value)
+				if !ok {
+					continue
+				}
+				sampleName := s.name
+				if metric, known := a.metricConfig(s.metric); known && sampleName == "" {
+					sampleName = metric.MetricName
+				}
+				values[name][seriesKey(sampleName, s.labels)] = f
+			}
+		}
+		return values
+	}))
+}
+
+// handleDebugVars handles the /debug/vars endpoint, serving the published
+// expvars
+func (a *App) handleDebugVars(w http.ResponseWriter, r *http.Request) {
+	if !a.requireAdmin(w, r) {
+		return
+	}
+	expvar.Handler().ServeHTTP(w, r)
+}
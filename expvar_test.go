@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestExpvars(t *testing.T) {
+	app := newTestApp(t, `{
+		"admin_token": "secret",
+		"database": {"driver": "mock", "mock": [
+			{"query": "SELECT region, SUM(total) AS value FROM orders GROUP BY region", "columns": ["region", "value"], "rows": [["eu", 3], ["us", 5]]},
+			{"query": "SELECT region, SUM(total) AS value FROM orders_v2 GROUP BY region", "columns": ["region", "value"], "rows": [["eu", 4], ["us", 5]]},
+			{"query": "SELECT value FROM broken", "error": "table broken doesn't exist"}
+		]},
+		"metrics": [
+			{"name": "orders_total", "query": "SELECT region, SUM(total) AS value FROM orders GROUP BY region"},
+			{"name": "broken", "query": "SELECT value FROM broken"}
+		]
+	}`)
+	app.publishExpvars()
+
+	vars := func(t *testing.T) (collections, errors int, lastValues map[string]map[string]float64) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/debug/vars", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		app.routes().ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET /debug/vars status = %d, want %d", rec.Code, http.StatusOK)
+		}
+
+		var got struct {
+			Collections *int                          `json:"sqlmetrics_collections"`
+			Errors      *int                          `json:"sqlmetrics_errors"`
+			LastValues  map[string]map[string]float64 `json:"sqlmetrics_last_values"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatalf("error decoding /debug/vars: %v", err)
+		}
+		if got.Collections == nil || got.Errors == nil || got.LastValues == nil {
+			t.Fatalf("/debug/vars doesn't publish the exporter's vars:\n%s", rec.Body)
+		}
+		return *got.Collections, *got.Errors, got.LastValues
+	}
+
+	collections, errors, lastValues := vars(t)
+	want := map[string]map[string]float64{
+		"orders_total": {`orders_total{region="eu"}`: 3, `orders_total{region="us"}`: 5},
+	}
+	if !reflect.DeepEqual(lastValues, want) {
+		t.Errorf("sqlmetrics_last_values = %v, want %v", lastValues, want)
+	}
+
+	// The vars follow later collections
+	changed := app.config.Metrics[0]
+	changed.Query = "SELECT region, SUM(total) AS value FROM orders_v2 GROUP BY region"
+	app.collectOne(context.Background(), changed)
+	app.collectOne(context.Background(), app.config.Metrics[1])
+
+	gotCollections, gotErrors, lastValues := vars(t)
+	if gotCollections != collections+2 {
+		t.Errorf("sqlmetrics_collections = %d, want %d", gotCollections, collections+2)
+	}
+	if gotErrors != errors+1 {
+		t.Errorf("sqlmetrics_errors = %d, want %d", gotErrors, errors+1)
+	}
+	if got := lastValues["orders_total"][`orders_total{region="eu"}`]; got != 4 {
+		t.Errorf("last value of orders_total{region=\"eu\"} = %g, want 4", got)
+	}
+
+	// Like the other debug endpoints, the vars need the admin token
+	rec := httptest.NewRecorder()
+	app.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/vars", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("GET /debug/vars without the admin token status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
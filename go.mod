@@ -2,6 +2,15 @@ module github.com/bpsizemore/custom-sql-metrics
 
 go 1.24.2
 
-require github.com/go-sql-driver/mysql v1.9.2
+require (
+	github.com/go-sql-driver/mysql v1.9.2
+	github.com/lib/pq v1.12.3
+	go.uber.org/automaxprocs v1.6.0
+	golang.org/x/crypto v0.38.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
-require filippo.io/edwards25519 v1.1.0 // indirect
+require (
+	filippo.io/edwards25519 v1.1.0 // indirect
+	github.com/kr/text v0.2.0 // indirect
+)
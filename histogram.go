@@ -0,0 +1,79 @@
+package main
+
+import (
+	"math"
+	"strconv"
+)
+
+// histogram accumulates the values of the rows sharing a label set into
+// classic histogram buckets
+type histogram struct {
+	labels map[string]string
+	// counts holds the cumulative count of values up to each bucket bound
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// newHistogram creates an empty histogram with the given number of buckets
+func newHistogram(labels map[string]string, buckets int) *histogram {
+	return &histogram{labels: labels, counts: make([]uint64, buckets)}
+}
+
+// observe adds a value to the histogram
+func (h *histogram) observe(value float64, bounds []float64) {
+	for i, bound := range bounds {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+// series returns the histogram's _bucket, _sum and _count series for the
+// metric, keyed as they are stored
+func (h *histogram) series(metric MetricConfig) map[string]timeSeries {
+	series := make(map[string]timeSeries, len(h.counts)+3)
+	add := func(name string, labels map[string]string, value interface{}) {
+		s := timeSeries{metric: metric.Name, name: metric.MetricName + name, labels: labels, value: value}
+		series[s.key()] = s
+	}
+
+	for i, bound := range metric.HistogramBuckets {
+		add("_bucket", withLabel(h.labels, "le", formatBound(bound)), h.counts[i])
+	}
+	add("_bucket", withLabel(h.labels, "le", formatBound(math.Inf(1))), h.count)
+	add("_sum", h.labels, h.sum)
+	add("_count", h.labels, h.count)
+	return series
+}
+
+// withLabel returns a copy of labels with the label name set to value
+func withLabel(labels map[string]string, name, value string) map[string]string {
+	copied := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		copied[k] = v
+	}
+	copied[name] = value
+	return copied
+}
+
+// withoutLabel returns a copy of labels without the label name
+func withoutLabel(labels map[string]string, name string) map[string]string {
+	copied := make(map[string]string, len(labels))
+	for k, v := range labels {
+		if k != name {
+			copied[k] = v
+		}
+	}
+	return copied
+}
+
+// formatBound formats a bucket bound as Prometheus client libraries do
+func formatBound(bound float64) string {
+	if math.IsInf(bound, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(bound, 'g', -1, 64)
+}
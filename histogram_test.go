@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHistogramBuckets(t *testing.T) {
+	logs := captureLog(t)
+	app := newTestApp(t, `{
+		"database": {"driver": "mock", "mock": [
+			{"query": "SELECT region, total AS value FROM orders", "columns": ["region", "value"], "rows": [
+				["eu", 5], ["eu", 10], ["eu", 42.5], ["eu", 99], ["eu", 1000], ["eu", "n/a"], ["us", 60]
+			]},
+			{"query": "SELECT total AS value FROM refunds", "columns": ["value"], "rows": []}
+		]},
+		"metrics": [
+			{"name": "order_value_dollars", "query": "SELECT region, total AS value FROM orders", "histogram_buckets": [10, 50, 100, 500]},
+			{"name": "refund_value_dollars", "query": "SELECT total AS value FROM refunds", "histogram_buckets": [10]}
+		]
+	}`)
+
+	// Buckets are cumulative and bounds are inclusive
+	body := scrape(t, app, "/metrics")
+	wantLines(t, body,
+		"# TYPE order_value_dollars histogram",
+		`order_value_dollars_bucket{le="10",region="eu"} 2`,
+		`order_value_dollars_bucket{le="50",region="eu"} 3`,
+		`order_value_dollars_bucket{le="100",region="eu"} 4`,
+		`order_value_dollars_bucket{le="500",region="eu"} 4`,
+		`order_value_dollars_bucket{le="+Inf",region="eu"} 5`,
+		`order_value_dollars_sum{region="eu"} 1156.5`,
+		`order_value_dollars_count{region="eu"} 5`,
+		`order_value_dollars_bucket{le="50",region="us"} 0`,
+		`order_value_dollars_bucket{le="100",region="us"} 1`,
+		`order_value_dollars_count{region="us"} 1`,
+	)
+	if strings.Contains(body, "\nrefund_value_dollars_") {
+		t.Errorf("/metrics has histogram series for a query returning no rows:\n%s", body)
+	}
+	if !strings.Contains(logs.String(), "Skipping non-numeric value of histogram order_value_dollars") {
+		t.Errorf("non-numeric value wasn't logged:\n%s", logs)
+	}
+
+	tests := []struct {
+		metric string
+		want   string
+	}{
+		{metric: `"histogram_buckets": [50, 10]`, want: "metric m has histogram buckets that aren't in increasing order"},
+		{metric: `"histogram_buckets": [10], "type": "gauge"`, want: "metric m has histogram buckets, so it must be a histogram without a name_column"},
+	}
+	for _, tt := range tests {
+		_, err := parseConfig(strings.NewReader(`{
+			"database": {"driver": "mock"},
+			"metrics": [{"name": "m", "query": "SELECT 1 AS value", `+tt.metric+`}]
+		}`), "test config", configFormatJSON, false)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: parseConfig() error = %v, want %q", tt.metric, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTPAdapter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method == http.MethodGet {
+			return
+		}
+
+		var req struct {
+			Query string        `json:"query"`
+			Args  []interface{} `json:"args"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Args == nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if req.Query != "SELECT dataset, value FROM tables" {
+			http.Error(w, "table broken doesn't exist", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, `{"columns": ["dataset", "value"], "rows": [["sales", 1024], ["marketing", 9007199254740993]]}`)
+	}))
+	defer server.Close()
+
+	app := newTestApp(t, fmt.Sprintf(`{
+		"database": {"driver": "http", "dsn": %q, "headers": {"Authorization": "Bearer secret"}},
+		"metrics": [{"name": "rows", "query": "SELECT dataset, value FROM tables"}]
+	}`, server.URL))
+
+	// Integers are kept exact rather than decoded as floats
+	wantLines(t, scrape(t, app, "/metrics"),
+		`rows{dataset="sales"} 1024`,
+		`rows{dataset="marketing"} 9007199254740993`,
+	)
+
+	adapter, err := newHTTPAdapter(DatabaseConfig{DSN: server.URL, Headers: map[string]string{"Authorization": "Bearer secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := adapter.Ping(context.Background()); err != nil {
+		t.Errorf("Ping() error = %v", err)
+	}
+	_, err = adapter.Query(context.Background(), "SELECT value FROM broken", nil)
+	if err == nil || !strings.Contains(err.Error(), "500 Internal Server Error: table broken doesn't exist") {
+		t.Errorf("Query() error = %v, want the server's error", err)
+	}
+
+	unauthorized, _ := newHTTPAdapter(DatabaseConfig{DSN: server.URL})
+	if err := unauthorized.Ping(context.Background()); err == nil {
+		t.Error("Ping() without the headers succeeded, want the 401 reported")
+	}
+
+	if _, err := newHTTPAdapter(DatabaseConfig{DSN: "bq-proxy.internal/query"}); err == nil {
+		t.Error("newHTTPAdapter() with a non-URL DSN succeeded")
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// autoLimitDrivers are the drivers whose SQL dialect has LIMIT
+var autoLimitDrivers = map[string]bool{
+	"mysql":    true,
+	"postgres": true,
+}
+
+// limitBlockers are the top-level keywords that keep a LIMIT from being
+// appended: the query already limits its rows, has clauses that must come
+// after LIMIT, or doesn't just read
+var limitBlockers = map[string]bool{
+	"LIMIT": true, "FETCH": true, "TOP": true, "OFFSET": true,
+	"FOR": true, "LOCK": true, "INTO": true, "PROCEDURE": true,
+	"INSERT": true, "UPDATE": true, "DELETE": true, "MERGE": true,
+}
+
+// injectLimit appends LIMIT n to a SELECT query that doesn't limit its rows,
+// reporting whether it did. Strings, quoted identifiers, comments and
+// subqueries are skipped when looking for a LIMIT, and other statements are
+// left alone. The LIMIT goes on a line of its own, so a trailing line comment
+// can't swallow it.
+func injectLimit(query string, n int) (string, bool) {
+	var first string
+	depth, end := 0, 0
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case isQuote(c):
+			j := quoteEnd(query, i)
+			if j == -1 {
+				// Unterminated, leave the query to the database
+				return query, false
+			}
+			i, end = j, j
+		case isComment(query, i):
+			j := commentEnd(query, i)
+			if j == -1 {
+				return query, false
+			}
+			i = j
+		case isWordChar(c) && (c < '0' || c > '9'):
+			j := i
+			for j < len(query) && isWordChar(query[j]) {
+				j++
+			}
+			word := strings.ToUpper(query[i:j])
+			if first == "" {
+				first = word
+			}
+			if depth == 0 && limitBlockers[word] {
+				return query, false
+			}
+			i, end = j, j
+		default:
+			switch c {
+			case '(':
+				depth++
+			case ')':
+				depth--
+			}
+			if c != ';' && c != ' ' && c != '\t' && c != '\n' && c != '\r' {
+				end = i + 1
+			}
+			i++
+		}
+	}
+
+	if first != "SELECT" && first != "WITH" {
+		return query, false
+	}
+	// Anything after the last token, like a semicolon or comment, goes
+	return fmt.Sprintf("%s\nLIMIT %d", query[:end], n), true
+}
+
+// isQuote reports whether c opens a string or quoted identifier
+func isQuote(c byte) bool {
+	return c == '\'' || c == '"' || c == '`'
+}
+
+// quoteEnd returns the index just past the string or quoted identifier
+// starting at query[i], with doubled or backslash-escaped quotes inside, or
+// -1 if it is unterminated
+func quoteEnd(query string, i int) int {
+	c := query[i]
+	for j := i + 1; j < len(query); j++ {
+		if query[j] == '\\' && c == '\'' {
+			j++
+			continue
+		}
+		if query[j] == c {
+			if j+1 < len(query) && query[j+1] == c {
+				j++
+				continue
+			}
+			return j + 1
+		}
+	}
+	return -1
+}
+
+// isComment reports whether a -- or /* */ comment starts at query[i]
+func isComment(query string, i int) bool {
+	return strings.HasPrefix(query[i:], "--") || strings.HasPrefix(query[i:], "/*")
+}
+
+// commentEnd returns the index just past the comment starting at query[i],
+// the end of its line for a -- comment, or -1 if a /* */ comment is
+// unterminated
+func commentEnd(query string, i int) int {
+	if strings.HasPrefix(query[i:], "--") {
+		if j := strings.IndexByte(query[i:], '\n'); j != -1 {
+			return i + j
+		}
+		return len(query)
+	}
+	if j := strings.Index(query[i+2:], "*/"); j != -1 {
+		return i + j + 4
+	}
+	return -1
+}
+
+// isWordChar reports whether c can be part of an SQL keyword or identifier
+func isWordChar(c byte) bool {
+	return c == '_' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
@@ -0,0 +1,105 @@
+package main
+
+import "testing"
+
+func TestInjectLimit(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		want   string
+		wantOK bool
+	}{
+		{
+			name:   "select",
+			query:  "SELECT id, n AS value FROM t",
+			want:   "SELECT id, n AS value FROM t\nLIMIT 100",
+			wantOK: true,
+		},
+		{
+			name:   "trailing semicolon",
+			query:  "SELECT n AS value FROM t;",
+			want:   "SELECT n AS value FROM t\nLIMIT 100",
+			wantOK: true,
+		},
+		{
+			name:   "trailing line comment",
+			query:  "SELECT n AS value FROM t -- all rows",
+			want:   "SELECT n AS value FROM t\nLIMIT 100",
+			wantOK: true,
+		},
+		{
+			name:   "with",
+			query:  "WITH c AS (SELECT n FROM t) SELECT n AS value FROM c",
+			want:   "WITH c AS (SELECT n FROM t) SELECT n AS value FROM c\nLIMIT 100",
+			wantOK: true,
+		},
+		{
+			name:   "limit in subquery",
+			query:  "SELECT n AS value FROM (SELECT n FROM t LIMIT 5) s",
+			want:   "SELECT n AS value FROM (SELECT n FROM t LIMIT 5) s\nLIMIT 100",
+			wantOK: true,
+		},
+		{
+			name:   "limit in string",
+			query:  "SELECT 'LIMIT 5' AS label, n AS value FROM t",
+			want:   "SELECT 'LIMIT 5' AS label, n AS value FROM t\nLIMIT 100",
+			wantOK: true,
+		},
+		{
+			name:   "limit in comment",
+			query:  "SELECT n AS value /* LIMIT 5 */ FROM t",
+			want:   "SELECT n AS value /* LIMIT 5 */ FROM t\nLIMIT 100",
+			wantOK: true,
+		},
+		{
+			name:   "escaped quote",
+			query:  `SELECT 'it''s', 'a\' LIMIT' AS label FROM t`,
+			want:   "SELECT 'it''s', 'a\\' LIMIT' AS label FROM t\nLIMIT 100",
+			wantOK: true,
+		},
+		{
+			name:  "already limited",
+			query: "SELECT n AS value FROM t LIMIT 5",
+			want:  "SELECT n AS value FROM t LIMIT 5",
+		},
+		{
+			name:  "fetch first",
+			query: "SELECT n AS value FROM t FETCH FIRST 5 ROWS ONLY",
+			want:  "SELECT n AS value FROM t FETCH FIRST 5 ROWS ONLY",
+		},
+		{
+			name:  "for update",
+			query: "SELECT n AS value FROM t FOR UPDATE",
+			want:  "SELECT n AS value FROM t FOR UPDATE",
+		},
+		{
+			name:  "lock in share mode",
+			query: "SELECT n AS value FROM t LOCK IN SHARE MODE",
+			want:  "SELECT n AS value FROM t LOCK IN SHARE MODE",
+		},
+		{
+			name:  "not a select",
+			query: "SHOW STATUS",
+			want:  "SHOW STATUS",
+		},
+		{
+			name:  "unterminated string",
+			query: "SELECT 'n AS value FROM t",
+			want:  "SELECT 'n AS value FROM t",
+		},
+		{
+			name:  "unterminated comment",
+			query: "SELECT n AS value FROM t /* all",
+			want:  "SELECT n AS value FROM t /* all",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := injectLimit(tt.query, 100)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("injectLimit() = %q, %v, want %q, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
@@ -1,20 +1,37 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	"go.uber.org/automaxprocs/maxprocs"
 )
 
 // Config holds the configuration for the application
@@ -23,6 +40,118 @@ type Config struct {
 	Interval time.Duration  `json:"interval"`
 	Metrics  []MetricConfig `json:"metrics"`
 	Database DatabaseConfig `json:"database"`
+
+	// Databases holds further databases by name, e.g. replicas or shards,
+	// which metrics select with their Database field
+	Databases map[string]DatabaseConfig `json:"databases"`
+
+	// SourceLabel is the name of an optional label added to every series
+	// with the name of the database that produced it
+	SourceLabel string `json:"source_label"`
+
+	// UnixSocket is an optional path of a Unix socket to serve on, in
+	// addition to the TCP port unless the port is 0
+	UnixSocket string `json:"unix_socket"`
+
+	// ExposeQueries includes each metric's query in /metrics.json. Queries
+	// can reveal schema details, so this is off by default.
+	ExposeQueries bool `json:"expose_queries"`
+
+	// AdminToken is the bearer token required by the debug endpoints, which
+	// are disabled when it is empty
+	AdminToken string `json:"admin_token"`
+
+	// MaskSecret keys the hashes of label values masked in hash mode, so
+	// they can't be reversed by hashing guessed values
+	MaskSecret string `json:"mask_secret"`
+
+	CircuitBreaker CircuitBreakerConfig `json:"circuit_breaker"`
+
+	HealthCheck HealthCheckConfig `json:"health_check"`
+
+	Probe ProbeConfig `json:"probe"`
+
+	Server ServerConfig `json:"server"`
+
+	Push PushConfig `json:"push"`
+
+	FailureWebhook WebhookConfig `json:"failure_webhook"`
+
+	// TextfilePath is a file the metrics are written to in the exposition
+	// format after each collection, for node_exporter's textfile collector
+	TextfilePath string `json:"textfile_path"`
+
+	// IdlePause pauses background collection while /metrics hasn't been
+	// scraped for this long, sparing the database when nobody is looking.
+	// Collection never pauses when it is zero.
+	IdlePause time.Duration `json:"idle_pause"`
+
+	// AutoLimit appends LIMIT AutoLimit to the SELECT queries on MySQL and
+	// PostgreSQL databases that don't limit their rows, so a query missing a
+	// WHERE clause can't return a whole table. Queries aren't limited when it
+	// is zero.
+	AutoLimit int `json:"auto_limit"`
+
+	// SharedTimestamp stamps every series of a /metrics scrape with one
+	// timestamp, that of the scrape ("scrape") or of the most recent
+	// collection ("collection"). Series are left to be timestamped by the
+	// scraper when it is empty.
+	SharedTimestamp string `json:"shared_timestamp"`
+
+	// StartupRetries is the number of further pings each database gets at
+	// startup before the exporter gives up, waiting StartupRetryInterval
+	// after the first failure and twice as long after each further one. The
+	// databases aren't checked at startup when it is zero.
+	StartupRetries       int           `json:"startup_retries"`
+	StartupRetryInterval time.Duration `json:"startup_retry_interval"`
+
+	// AutoTimeoutFraction is the fraction of their interval that metrics with
+	// an "auto" timeout may take
+	AutoTimeoutFraction float64 `json:"auto_timeout_fraction"`
+
+	// ConcurrencyFactor caps the number of collections running at once at
+	// this multiple of GOMAXPROCS, so a container's CPU limit isn't swamped
+	ConcurrencyFactor float64 `json:"concurrency_factor"`
+
+	// CollectorStartBatch is the number of collectors started at once, on
+	// startup and reload. Further collectors are started once those have
+	// finished their first collection. All are started at once when it is 0.
+	CollectorStartBatch int `json:"collector_start_batch"`
+
+	Vault VaultConfig `json:"vault"`
+
+	// AllowEnvOverrides lets environment variables such as PORT and DB_DSN
+	// override the config. EnvOverrides restricts this to the listed
+	// variables when set.
+	AllowEnvOverrides bool     `json:"allow_env_overrides"`
+	EnvOverrides      []string `json:"env_overrides"`
+
+	// problems are the invalid values found while loading the config, which
+	// are reported by Validate
+	problems []error
+
+	// etag and checksum identify a config fetched from a URL, so that
+	// watching the URL only reloads once the config there changes
+	etag     string
+	checksum [sha256.Size]byte
+}
+
+// HealthCheckConfig holds the configuration for the database ping behind /health
+type HealthCheckConfig struct {
+	// Timeout bounds each ping so a hung database fails the check promptly
+	Timeout time.Duration `json:"timeout"`
+	// Retries is the number of further pings after a failed one
+	Retries int `json:"retries"`
+}
+
+// CircuitBreakerConfig holds the configuration for the per-metric circuit breakers
+type CircuitBreakerConfig struct {
+	// Retries is the number of immediate retries before a collection counts as failed
+	Retries int `json:"retries"`
+	// Threshold is the number of consecutive failures that opens the breaker (0 disables it)
+	Threshold int `json:"threshold"`
+	// MaxBackoff caps the time between probes while the breaker is open
+	MaxBackoff time.Duration `json:"max_backoff"`
 }
 
 // DatabaseConfig holds the configuration for the database connection
@@ -32,6 +161,17 @@ type DatabaseConfig struct {
 	MaxOpen  int    `json:"max_open"`
 	MaxIdle  int    `json:"max_idle"`
 	Lifetime int    `json:"lifetime"`
+
+	// Warmup opens MaxIdle connections when the pool is created, so the
+	// first collections don't pay for establishing them
+	Warmup bool `json:"warmup"`
+
+	// Mock holds the canned result sets served when Driver is "mock"
+	Mock []MockResult `json:"mock"`
+
+	// Headers are sent with every request when Driver is "http", e.g. for
+	// authorization
+	Headers map[string]string `json:"headers"`
 }
 
 // MetricConfig holds the configuration for a single metric
@@ -39,315 +179,2247 @@ type MetricConfig struct {
 	Name     string        `json:"name"`
 	Query    string        `json:"query"`
 	Interval time.Duration `json:"interval"`
+
+	// Type is the metric's type: gauge (the default), counter, histogram,
+	// summary or check. Histograms and summaries are built from rows naming
+	// their samples in NameColumn, unless HistogramBuckets is set. A check is
+	// a gauge of whether its boolean-ish value is healthy, exposed as
+	// sqlmetrics_check_up with the metric's name as check label; check marks
+	// such a metric once its type is turned into a gauge.
+	Type  string `json:"type"`
+	check bool
+
+	// HistogramBuckets are the upper bounds of the buckets the value of
+	// each row is observed into, making the metric a histogram of the raw
+	// values the query returns
+	HistogramBuckets []float64 `json:"histogram_buckets"`
+
+	// Min and Max bound the plausible values of the metric, values outside
+	// the bounds are handled according to ClampMode
+	Min       *float64 `json:"min"`
+	Max       *float64 `json:"max"`
+	ClampMode string   `json:"clamp_mode"`
+
+	// NameColumn and TypeColumn let each row of the query name its own
+	// metric and declare its type, so one query can drive many metrics
+	NameColumn string `json:"name_column"`
+	TypeColumn string `json:"type_column"`
+
+	// MaxOpen and MaxIdle give the metric its own connection pool of this size
+	// instead of sharing the database pool
+	MaxOpen int `json:"max_open"`
+	MaxIdle int `json:"max_idle"`
+
+	// SampleEvery runs the query only on every Nth interval, serving the
+	// cached values in between
+	SampleEvery int `json:"sample_every"`
+
+	// StringValueAsLabel emits rows whose value column isn't numeric as an
+	// info-style series with value 1 and the string in a "value" label
+	StringValueAsLabel bool `json:"string_value_as_label"`
+
+	// PresenceOnly emits a gauge of 1 for each returned row with all of its
+	// columns as labels, for checks that a row exists. No value column is
+	// needed.
+	PresenceOnly bool `json:"presence_only"`
+
+	// ValueColumn is the column holding the value, "value" by default
+	ValueColumn string `json:"value_column"`
+
+	// ValueColumns lists the columns holding values when the query returns
+	// several per row, e.g. min, max and avg. Each is exposed as its own
+	// metric named <metric_name>_<column>, optionally with its own help, type
+	// and unit, and the remaining columns are labels. A single ValueColumn is
+	// expected when it is empty.
+	ValueColumns []ValueColumnConfig `json:"value_columns"`
+
+	// TimestampColumn is an optional column holding each row's event time,
+	// exposed as the timestamp of its samples: a time, milliseconds since the
+	// epoch, or an RFC 3339 string. Rows with invalid timestamps are skipped.
+	TimestampColumn string `json:"timestamp_column"`
+
+	// Scalar takes the value from the single column of the single row the
+	// query returns, whatever the column is named, e.g. for
+	// SELECT COUNT(*) FROM t. More columns are an error, more rows are
+	// handled according to OnMultiRow.
+	Scalar     bool   `json:"scalar"`
+	OnMultiRow string `json:"on_multi_row"`
+
+	// ExpectedColumns guards against schema changes silently shifting which
+	// column is the value or a label. Order is only checked with
+	// CheckColumnOrder.
+	ExpectedColumns  []string `json:"expected_columns"`
+	CheckColumnOrder bool     `json:"check_column_order"`
+
+	// MinRows and MaxRows are the range of row counts the query normally
+	// returns, a count outside it is flagged as an anomaly
+	MinRows *int `json:"min_rows"`
+	MaxRows *int `json:"max_rows"`
+
+	// LatestRowOnly keeps a single row of a time-ordered result, the last one
+	// unless LatestRow is "first"
+	LatestRowOnly bool   `json:"latest_row_only"`
+	LatestRow     string `json:"latest_row"`
+
+	// Labels are constant labels added to every series of the metric, e.g.
+	// env="prod". A column of the same name takes precedence.
+	Labels map[string]string `json:"labels"`
+
+	// MaskLabels lists label columns holding sensitive values that are
+	// replaced according to MaskMode before being exposed
+	MaskLabels []string `json:"mask_labels"`
+	MaskMode   string   `json:"mask_mode"`
+
+	// Unit is the metric's unit, e.g. seconds or bytes, exposed in OpenMetrics
+	// output. The name must end in the unit.
+	Unit string `json:"unit"`
+
+	// ValueFormat controls how values are rendered in /metrics: "int",
+	// "float", or "auto" to infer it from the type the query returned
+	ValueFormat string `json:"value_format"`
+
+	// DecimalSeparator is the decimal separator of values the driver returns
+	// as text, e.g. "," for drivers following a German locale. It is replaced
+	// with a point before parsing.
+	DecimalSeparator string `json:"decimal_separator"`
+
+	// DependsOn lists metrics that are collected before this one on each of
+	// its collections, e.g. ones whose queries refresh a table it reads
+	DependsOn []string `json:"depends_on"`
+
+	// MetricName is the name the metric is exposed under, defaulting to Name.
+	// Entries sharing a MetricName are rendered as one family, e.g. the same
+	// gauge with different labels from separate queries, and must agree on
+	// its type and unit.
+	MetricName string `json:"metric_name"`
+
+	// Database is the name of the entry in Config.Databases the query runs
+	// on, the main database when empty
+	Database string `json:"database"`
+
+	// OnScrape runs the query on every scrape of /metrics instead of on an
+	// interval. Params lists the :name placeholders of the query that are
+	// bound from param_<name> in the scrape URL.
+	OnScrape bool     `json:"on_scrape"`
+	Params   []string `json:"params"`
+
+	// MetadataQuery returns (name, help, type, unit) rows describing the
+	// metrics the query exposes, refreshed every MetadataInterval
+	MetadataQuery    string        `json:"metadata_query"`
+	MetadataInterval time.Duration `json:"metadata_interval"`
+
+	// DuplicateColumns is what to do when the query returns several columns
+	// of the same name: "error" or "rename" to append the column's index
+	DuplicateColumns string `json:"duplicate_columns"`
+
+	// RowFilter drops the rows that don't match it, for results that can't
+	// easily be filtered in SQL, e.g. "status != 'archived' and count >= 10".
+	// rowFilter is its parsed form.
+	RowFilter string `json:"row_filter"`
+	rowFilter rowFilter
+
+	// Timeout bounds the metric's query. With AutoTimeout, set by a timeout
+	// of "auto", it is instead Config.AutoTimeoutFraction of the interval so
+	// the query can't overrun its schedule.
+	Timeout     time.Duration `json:"timeout"`
+	AutoTimeout bool          `json:"-"`
+
+	// StaleAfter is a grace period after a missed collection before the
+	// metric's series are dropped as stale. Series are kept until the next
+	// successful collection when it is zero.
+	StaleAfter time.Duration `json:"stale_after"`
+
+	// Output restricts the metric's series to a single destination:
+	// "scrape", "push" or "textfile". They go to every configured
+	// destination when it is empty.
+	Output string `json:"output"`
+
+	// Delta exposes the change of each series' value since the previous
+	// collection instead of the value, for queries returning cumulative
+	// counters
+	Delta bool `json:"delta"`
+
+	// TrackRowsExamined exposes how many rows the metric's query read, to
+	// find inefficient queries. It is only supported on MySQL.
+	TrackRowsExamined bool `json:"track_rows_examined"`
+
+	// FailureWebhookURL is notified of the metric's failed collections
+	// instead of the URL of Config.FailureWebhook
+	FailureWebhookURL string `json:"failure_webhook_url"`
+
+	// Phase delays the metric's first collection, and so offsets its whole
+	// schedule, to keep metrics of the same interval from running together
+	Phase time.Duration `json:"phase"`
+}
+
+// Destinations a metric's series can be routed to
+const (
+	outputScrape   = "scrape"
+	outputPush     = "push"
+	outputTextfile = "textfile"
+)
+
+// metricStats holds the exporter's own statistics about a metric
+type metricStats struct {
+	// clamped counts values outside the metric's bounds
+	clamped int
+	// drift is how late the last collection started relative to its schedule
+	drift time.Duration
+	// schemaMismatch is set while the query's columns don't match ExpectedColumns
+	schemaMismatch bool
+	// rowCountOutOfRange is set while the query's row count is outside
+	// MinRows and MaxRows
+	rowCountOutOfRange bool
+	// collected is when the metric was last collected successfully
+	collected time.Time
+	// failures counts the collections that failed, after retries, since the
+	// last successful one
+	failures int
+	// skipped counts the collections skipped for each reason
+	skipped map[string]int
+	// running is set while a collection of the metric runs
+	running bool
+	// queryTime is the total time spent running the metric's query
+	queryTime time.Duration
+	// lastQueryTime is how long the last run of the metric's query took
+	lastQueryTime time.Duration
+	// collections counts the metric's queries run in the background
+	collections int
+	// errors counts the metric's collections that failed after retries
+	errors int
+	// succeeded is set while the last query of the metric succeeded
+	succeeded bool
+	// rowsExamined is how many rows the last query read, with TrackRowsExamined
+	rowsExamined int64
+	// connAcquireTime is how long the last query waited for a connection
+	connAcquireTime time.Duration
+	// notified is when the failure webhook was last notified about the metric
+	notified time.Time
+	// previous holds the values of the last collection by series key, which
+	// a Delta metric's changes are computed from
+	previous map[string]float64
+	// checksum is the checksum of the last successful query's result
+	checksum uint64
+	// resultChanges counts the successful queries whose result differed
+	// from the one before
+	resultChanges int
+}
+
+// Reasons for skipping a collection
+const (
+	// skipOverlap is a collection skipped because the previous one was still running
+	skipOverlap = "overlap"
+	// skipCircuitOpen is a collection skipped by an open circuit breaker
+	skipCircuitOpen = "circuit_open"
+	// skipSchedule is a tick skipped by sample_every
+	skipSchedule = "schedule"
+	// skipIdle is a tick skipped while nobody scrapes the metrics
+	skipIdle = "idle"
+)
+
+// skipReasons lists the reasons for skipping a collection
+var skipReasons = []string{skipCircuitOpen, skipIdle, skipOverlap, skipSchedule}
+
+// Clamp modes for values outside a metric's bounds
+const (
+	clampModeClamp  = "clamp"
+	clampModeReject = "reject"
+)
+
+// Ways of handling duplicate column names
+const (
+	duplicateColumnsError  = "error"
+	duplicateColumnsRename = "rename"
+)
+
+// Value formats for rendering samples
+const (
+	valueFormatAuto  = "auto"
+	valueFormatInt   = "int"
+	valueFormatFloat = "float"
+)
+
+// Mask modes for sensitive label values
+const (
+	// maskModeHash replaces values with a stable keyed hash, preserving
+	// cardinality
+	maskModeHash = "hash"
+	// maskModePlaceholder replaces every value with maskPlaceholder
+	maskModePlaceholder = "placeholder"
+)
+
+// maskPlaceholder replaces masked label values in placeholder mode
+const maskPlaceholder = "masked"
+
+// defaultDatabase is the name the main database is reported under
+const defaultDatabase = "default"
+
+// Health states reported by /health and /ready
+const (
+	healthOK       = "ok"
+	healthDegraded = "degraded"
+	healthDown     = "down"
+	// healthStarting is a reachable exporter yet to collect a metric
+	healthStarting = "starting"
+)
+
+// Rows kept by latest-row-only metrics
+const (
+	latestRowFirst = "first"
+	latestRowLast  = "last"
+)
+
+// Handling of the extra rows returned by scalar queries
+const (
+	multiRowError = "error"
+	multiRowFirst = "first"
+	multiRowLast  = "last"
+	multiRowSum   = "sum"
+)
+
+// timeSeries is a stored series produced by a metric's query
+type timeSeries struct {
+	// metric is the name of the config entry whose query produced the series
+	metric string
+	// name and metricType are the series' own name and type, for rows that
+	// declared them in a name or type column
+	name       string
+	metricType string
+	labels     map[string]string
+	value      interface{}
+	// timestamp is the sample's time from the metric's timestamp column, zero
+	// when the sample is current
+	timestamp time.Time
+}
+
+// key returns the key the series is stored under. The metric is kept in the
+// series, so the key only has to be unique.
+func (s timeSeries) key() string {
+	return s.metric + "/" + seriesKey(s.name, s.labels)
+}
+
+// grouped reports whether the series is one of many of its metric, rather
+// than the metric's single unlabeled value
+func (s timeSeries) grouped() bool {
+	return len(s.labels) > 0 || s.name != "" || s.metricType != ""
 }
 
 // App holds the application state
 type App struct {
 	config     Config
 	db         *sql.DB
-	metrics    map[string]interface{}
+	metricDBs  map[string]*sql.DB
+	namedDBs   map[string]*sql.DB
+	dbMux      sync.RWMutex
+	server     *http.Server
+	metrics    map[string]map[string]timeSeries // by metric name, then series key
 	metricsMux sync.RWMutex
+	breakers   map[string]*circuitBreaker
+	stats      map[string]*metricStats
+	runOrders  map[string][]MetricConfig
+	metadata   map[string]metricMetadata
+
+	// collectSlots bounds the number of collections running at once
+	collectSlots chan struct{}
+
+	// collectors holds the cancel func of each metric's collection
+	// goroutines, started under ctx
+	ctx          context.Context
+	collectors   map[string]context.CancelFunc
+	collectorMux sync.Mutex
+	// collectorWG tracks the running collection goroutines
+	collectorWG sync.WaitGroup
+
+	vault      *vaultClient
+	vaultLease *vaultLease
+
+	// textfileMux serializes writes of the textfile
+	textfileMux sync.Mutex
+
+	// shuttingDown is set once Shutdown has been called so that new scrapes
+	// are rejected while in-flight requests drain
+	shuttingDown atomic.Bool
+	// lastScrape is when the metrics were last scraped, in Unix nanoseconds
+	lastScrape atomic.Int64
+	// stopped is closed once Shutdown has finished
+	stopped chan struct{}
+
+	// configPath and strictConfig are where the config was loaded from and
+	// how, to load it again on reload
+	configPath   string
+	strictConfig bool
 }
 
 // NewApp creates a new instance of the App
 func NewApp(config Config) (*App, error) {
-	db, err := sql.Open(config.Database.Driver, config.Database.DSN)
+	app := &App{
+		config:   config,
+		server:   &http.Server{Addr: fmt.Sprintf(":%d", config.Port)},
+		metrics:  make(map[string]map[string]timeSeries),
+		breakers: make(map[string]*circuitBreaker),
+		stats:    make(map[string]*metricStats),
+		metadata: make(map[string]metricMetadata),
+
+		collectSlots: make(chan struct{}, collectionConcurrency(config.ConcurrencyFactor)),
+		collectors:   make(map[string]context.CancelFunc),
+		stopped:      make(chan struct{}),
+	}
+	app.server.Handler = app.routes()
+
+	tlsConfig, err := serverTLSConfig(config.Server.TLS)
 	if err != nil {
-		return nil, fmt.Errorf("error opening database: %w", err)
+		return nil, err
 	}
+	app.server.TLSConfig = tlsConfig
 
-	db.SetMaxOpenConns(config.Database.MaxOpen)
-	db.SetMaxIdleConns(config.Database.MaxIdle)
-	db.SetConnMaxLifetime(time.Duration(config.Database.Lifetime) * time.Second)
+	// Collect from the start, the first scrape may be a while off
+	app.lastScrape.Store(time.Now().UnixNano())
 
-	app := &App{
-		config:  config,
-		db:      db,
-		metrics: make(map[string]interface{}),
+	// Dynamic credentials from Vault replace the configured DSN
+	if config.Vault.SecretPath != "" {
+		app.vault = newVaultClient(config.Vault)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		lease, err := app.vault.readCredentials(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching database credentials from vault: %w", err)
+		}
+		app.vaultLease = lease
+		app.config.Database.DSN = lease.dsn(config.Vault.DSNTemplate)
+	}
+
+	runOrders, err := dependencyOrders(config.Metrics)
+	if err != nil {
+		return nil, fmt.Errorf("error in metric dependencies: %w", err)
+	}
+	app.runOrders = runOrders
+
+	db, metricDBs, err := openPools(app.config.Database, config.Metrics)
+	if err != nil {
+		return nil, err
+	}
+	app.db = db
+	app.metricDBs = metricDBs
+
+	namedDBs, err := openNamedDBs(config.Databases)
+	if err != nil {
+		closePools(db, metricDBs)
+		return nil, err
+	}
+	app.namedDBs = namedDBs
+
+	for _, metric := range config.Metrics {
+		app.breakers[metric.Name] = newMetricBreaker(config.CircuitBreaker, metric)
+		app.stats[metric.Name] = &metricStats{}
 	}
 
 	return app, nil
 }
 
+// routes returns the App's own mux with its handlers registered, so several
+// Apps can serve in one process
+func (a *App) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", a.requireAuth(a.handleMetrics))
+	mux.HandleFunc("/metrics.json", a.requireAuth(a.handleMetricsJSON))
+	mux.HandleFunc("/health", a.handleHealth)
+	mux.HandleFunc("/ready", a.handleReady)
+	mux.HandleFunc("/probe", a.requireAuth(a.handleProbe))
+	mux.HandleFunc("/debug/metrics", a.handleDebugMetrics)
+	mux.HandleFunc("/debug/vars", a.handleDebugVars)
+	mux.HandleFunc("/-/reload", a.handleReload)
+	mux.HandleFunc("/-/quit", a.handleQuit)
+	return mux
+}
+
+// newMetricBreaker creates the circuit breaker of a metric, whose backoff is
+// counted in the metric's intervals
+func newMetricBreaker(config CircuitBreakerConfig, metric MetricConfig) *circuitBreaker {
+	maxSkip := 1
+	if metric.Interval > 0 {
+		maxSkip = int(config.MaxBackoff / metric.Interval)
+	}
+	return newCircuitBreaker(config.Threshold, maxSkip)
+}
+
+// openDB opens a connection pool for the database config
+func openDB(cfg DatabaseConfig) (*sql.DB, error) {
+	var db *sql.DB
+	if newAdapter, ok := queryAdapters[cfg.Driver]; ok {
+		adapter, err := newAdapter(cfg)
+		if err != nil {
+			return nil, err
+		}
+		db = sql.OpenDB(&adapterConnector{adapter: adapter})
+	} else {
+		var err error
+		if db, err = sql.Open(cfg.Driver, cfg.DSN); err != nil {
+			return nil, err
+		}
+	}
+
+	db.SetMaxOpenConns(cfg.MaxOpen)
+	db.SetMaxIdleConns(cfg.MaxIdle)
+	db.SetConnMaxLifetime(time.Duration(cfg.Lifetime) * time.Second)
+
+	if cfg.Warmup {
+		// The pool never keeps more idle connections than it may open
+		idle := cfg.MaxIdle
+		if cfg.MaxOpen > 0 && cfg.MaxOpen < idle {
+			idle = cfg.MaxOpen
+		}
+		// A database that isn't up yet is reported by the first collection
+		if err := warmup(db, idle); err != nil {
+			log.Printf("Error warming up connection pool: %v", err)
+		}
+	}
+	return db, nil
+}
+
+// warmupTimeout bounds the warmup of a connection pool
+const warmupTimeout = 10 * time.Second
+
+// warmup opens n connections and returns them to the pool as idle ones
+func warmup(db *sql.DB, n int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), warmupTimeout)
+	defer cancel()
+
+	// Hold every connection until all are open, or the pool would hand out
+	// the same one again
+	conns := make([]*sql.Conn, 0, n)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	for i := 0; i < n; i++ {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			return err
+		}
+		conns = append(conns, conn)
+		if err := conn.PingContext(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// supportedDrivers returns the names of the compiled-in SQL drivers and of
+// the query adapters
+func supportedDrivers() []string {
+	drivers := sql.Drivers()
+	for name := range queryAdapters {
+		drivers = append(drivers, name)
+	}
+	sort.Strings(drivers)
+	return drivers
+}
+
+// driverSupported reports whether name is a supported driver
+func driverSupported(name string) bool {
+	for _, driver := range supportedDrivers() {
+		if driver == name {
+			return true
+		}
+	}
+	return false
+}
+
+// openPools opens the shared connection pool along with a dedicated pool for
+// every metric on the main database with its own pool sizing, so a heavy
+// query can't starve the others
+func openPools(dbConfig DatabaseConfig, metrics []MetricConfig) (*sql.DB, map[string]*sql.DB, error) {
+	db, err := openDB(dbConfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening database: %w", err)
+	}
+
+	metricDBs := make(map[string]*sql.DB)
+	for _, metric := range metrics {
+		if metric.Database != "" || (metric.MaxOpen <= 0 && metric.MaxIdle <= 0) {
+			continue
+		}
+
+		metricConfig := dbConfig
+		metricConfig.MaxOpen = metric.MaxOpen
+		metricConfig.MaxIdle = metric.MaxIdle
+
+		metricDB, err := openDB(metricConfig)
+		if err != nil {
+			closePools(db, metricDBs)
+			return nil, nil, fmt.Errorf("error opening database for metric %s: %w", metric.Name, err)
+		}
+		metricDBs[metric.Name] = metricDB
+	}
+
+	return db, metricDBs, nil
+}
+
+// closePools closes a shared pool and its per-metric pools
+func closePools(db *sql.DB, metricDBs map[string]*sql.DB) error {
+	err := db.Close()
+	for _, metricDB := range metricDBs {
+		if closeErr := metricDB.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// sharedDB returns the connection pool shared by all metrics
+func (a *App) sharedDB() *sql.DB {
+	a.dbMux.RLock()
+	defer a.dbMux.RUnlock()
+	return a.db
+}
+
+// dbFor returns the connection pool the metric's query runs on
+func (a *App) dbFor(metric MetricConfig) *sql.DB {
+	a.dbMux.RLock()
+	defer a.dbMux.RUnlock()
+
+	if metric.Database != "" {
+		return a.namedDBs[metric.Database]
+	}
+	if db, ok := a.metricDBs[metric.Name]; ok {
+		return db
+	}
+	return a.db
+}
+
+// driverFor returns the driver of the database the metric's query runs on
+func (a *App) driverFor(metric MetricConfig) string {
+	a.metricsMux.RLock()
+	defer a.metricsMux.RUnlock()
+
+	if metric.Database != "" {
+		return a.config.Databases[metric.Database].Driver
+	}
+	return a.config.Database.Driver
+}
+
+// replaceDBs opens new connection pools for dbConfig and swaps them in for
+// the current ones, which are closed once their in-flight queries finish
+func (a *App) replaceDBs(dbConfig DatabaseConfig, metrics []MetricConfig) error {
+	db, metricDBs, err := openPools(dbConfig, metrics)
+	if err != nil {
+		return err
+	}
+	a.swapDBs(db, metricDBs, nil)
+	return nil
+}
+
+// swapDBs swaps in the shared and per-metric pools, unless db is nil, and the
+// named databases, unless namedDBs is nil, all at once. The pools they
+// replace are closed once their in-flight queries finish. The new pools are
+// in use by then, so errors closing the old ones are only logged.
+func (a *App) swapDBs(db *sql.DB, metricDBs map[string]*sql.DB, namedDBs map[string]*sql.DB) {
+	a.dbMux.Lock()
+	oldDB, oldMetricDBs, oldNamedDBs := a.db, a.metricDBs, a.namedDBs
+	if db != nil {
+		a.db, a.metricDBs = db, metricDBs
+	}
+	if namedDBs != nil {
+		a.namedDBs = namedDBs
+	}
+	a.dbMux.Unlock()
+
+	if db != nil {
+		if err := closePools(oldDB, oldMetricDBs); err != nil {
+			log.Printf("Error closing replaced database: %v", err)
+		}
+	}
+	if namedDBs != nil {
+		for name, old := range oldNamedDBs {
+			if err := old.Close(); err != nil {
+				log.Printf("Error closing replaced database %s: %v", name, err)
+			}
+		}
+	}
+}
+
+// closeDBs closes the shared pool, every per-metric pool and the named
+// databases
+func (a *App) closeDBs() error {
+	a.dbMux.RLock()
+	defer a.dbMux.RUnlock()
+
+	err := closePools(a.db, a.metricDBs)
+	for _, db := range a.namedDBs {
+		if closeErr := db.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
 // Start starts the application
 func (a *App) Start(ctx context.Context) error {
 	// Start collecting metrics
-	for _, metric := range a.config.Metrics {
-		go a.collectMetric(ctx, metric)
+	a.collectorMux.Lock()
+	a.ctx = ctx
+	a.startCollectors(a.config.Metrics)
+	a.collectorMux.Unlock()
+
+	if a.vault != nil {
+		go a.maintainVaultLease(ctx)
+	}
+
+	if a.config.Push.URL != "" {
+		go a.pushMetrics(ctx)
+	}
+
+	// Shut the server down once the context is cancelled
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := a.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Error shutting down: %v", err)
+		}
+	}()
+
+	listeners, err := a.listen()
+	if err != nil {
+		return err
+	}
+
+	errCh := make(chan error, len(listeners))
+	for _, ln := range listeners {
+		log.Printf("Starting server on %s", ln.Addr())
+		go func(ln net.Listener) {
+			if a.server.TLSConfig != nil {
+				// The certificate is already in the TLS config
+				errCh <- a.server.ServeTLS(ln, "", "")
+				return
+			}
+			errCh <- a.server.Serve(ln)
+		}(ln)
+	}
+
+	// Shutdown closes every listener, so the first to return is enough
+	if err := <-errCh; err != http.ErrServerClosed {
+		return err
+	}
+	<-a.stopped
+	return nil
+}
+
+// listen opens the Unix socket and/or TCP listeners the server is served on.
+// The TCP port is always used unless a Unix socket is configured and the port
+// is disabled.
+func (a *App) listen() ([]net.Listener, error) {
+	var listeners []net.Listener
+
+	if a.config.UnixSocket != "" {
+		// Remove a stale socket left behind by a previous run
+		if err := os.Remove(a.config.UnixSocket); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("error removing stale unix socket: %w", err)
+		}
+
+		ln, err := net.Listen("unix", a.config.UnixSocket)
+		if err != nil {
+			return nil, fmt.Errorf("error listening on unix socket: %w", err)
+		}
+		listeners = append(listeners, ln)
+	}
+
+	if a.config.UnixSocket == "" || a.config.Port > 0 {
+		ln, err := net.Listen("tcp", a.server.Addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("error listening on %s: %w", a.server.Addr, err)
+		}
+		listeners = append(listeners, ln)
+	}
+
+	return listeners, nil
+}
+
+// shutdownTimeout bounds how long a shutdown waits for in-flight scrapes and
+// collections to finish
+const shutdownTimeout = 30 * time.Second
+
+// Shutdown stops the collectors and rejects new scrapes, waits for in-flight
+// requests and collections to complete and then closes the databases
+func (a *App) Shutdown(ctx context.Context) error {
+	if a.shuttingDown.Swap(true) {
+		return nil
+	}
+	defer close(a.stopped)
+
+	// Stop collecting, which cancels the queries in flight
+	a.collectorMux.Lock()
+	for name := range a.collectors {
+		a.stopCollector(name)
+	}
+	a.collectorMux.Unlock()
+
+	err := a.server.Shutdown(ctx)
+
+	// Let the collectors finish before closing their databases
+	collectorsDone := make(chan struct{})
+	go func() {
+		a.collectorWG.Wait()
+		close(collectorsDone)
+	}()
+	select {
+	case <-collectorsDone:
+	case <-ctx.Done():
 	}
 
-	// Start HTTP server
-	http.HandleFunc("/metrics", a.handleMetrics)
-	http.HandleFunc("/metrics.json", a.handleMetricsJSON)
-	http.HandleFunc("/health", a.handleHealth)
+	if dbErr := a.closeDBs(); err == nil {
+		err = dbErr
+	}
+
+	// Closing the listener normally unlinks the socket, but make sure
+	if a.config.UnixSocket != "" {
+		if rmErr := os.Remove(a.config.UnixSocket); rmErr != nil && !os.IsNotExist(rmErr) && err == nil {
+			err = rmErr
+		}
+	}
+	return err
+}
+
+// rejectIfShuttingDown responds with 503 when the app is shutting down and
+// reports whether the request was rejected
+func (a *App) rejectIfShuttingDown(w http.ResponseWriter) bool {
+	if !a.shuttingDown.Load() {
+		return false
+	}
+	w.Header().Set("Connection", "close")
+	http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+	return true
+}
 
-	serverAddr := fmt.Sprintf(":%d", a.config.Port)
-	log.Printf("Starting server on %s", serverAddr)
-	return http.ListenAndServe(serverAddr, nil)
+// collectionConcurrency returns the number of collections that may run at
+// once for the concurrency factor, at least one
+func collectionConcurrency(factor float64) int {
+	return max(1, int(math.Ceil(factor*float64(runtime.GOMAXPROCS(0)))))
 }
 
-// collectMetric collects a single metric at the specified interval
-func (a *App) collectMetric(ctx context.Context, metric MetricConfig) {
+// collectMetric collects a single metric at the specified interval. started
+// is called once the first collection has finished, or right away when the
+// first collection waits for the metric's phase.
+func (a *App) collectMetric(ctx context.Context, metric MetricConfig, started func()) {
+	// Offset the schedule by the metric's phase
+	if metric.Phase > 0 {
+		started()
+		timer := time.NewTimer(metric.Phase)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+
 	ticker := time.NewTicker(metric.Interval)
 	defer ticker.Stop()
 
 	// Collect the metric immediately
-	a.runQuery(metric)
+	a.collect(ctx, metric)
+	if metric.Phase <= 0 {
+		started()
+	}
 
+	ticks := 0
 	for {
 		select {
-		case <-ticker.C:
-			a.runQuery(metric)
+		case scheduled := <-ticker.C:
+			drift := time.Since(scheduled)
+			a.recordDrift(metric, drift)
+
+			// The ticker drops the ticks that passed while an overrunning
+			// collection was still running
+			if missed := int(drift / metric.Interval); missed > 0 {
+				a.recordSkips(metric, skipOverlap, missed)
+			}
+
+			// Only sample every Nth tick, the cache serves the rest
+			ticks++
+			if metric.SampleEvery > 1 && ticks%metric.SampleEvery != 0 {
+				a.recordSkips(metric, skipSchedule, 1)
+				continue
+			}
+			if a.idle() {
+				a.recordSkips(metric, skipIdle, 1)
+				continue
+			}
+			a.collect(ctx, metric)
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-// runQuery executes the metric's query and stores the result
-func (a *App) runQuery(metric MetricConfig) {
-	// Get column information
-	rows, err := a.db.Query(metric.Query)
-	if err != nil {
-		log.Printf("Error executing query for metric %s: %v", metric.Name, err)
-		return
+// idle reports whether background collection is paused because the metrics
+// haven't been scraped within the idle pause
+func (a *App) idle() bool {
+	if a.config.IdlePause <= 0 {
+		return false
+	}
+	return time.Since(time.Unix(0, a.lastScrape.Load())) > a.config.IdlePause
+}
+
+// recordSkips records n collections of the metric skipped for reason
+func (a *App) recordSkips(metric MetricConfig, reason string, n int) {
+	a.metricsMux.Lock()
+	defer a.metricsMux.Unlock()
+
+	stats := a.stats[metric.Name]
+	if stats.skipped == nil {
+		stats.skipped = make(map[string]int)
+	}
+	stats.skipped[reason] += n
+}
+
+// recordDrift records how late a collection started relative to its tick.
+// The ticker buffers a single tick, so a collection that overruns its
+// interval shows up as drift on the next one.
+func (a *App) recordDrift(metric MetricConfig, drift time.Duration) {
+	a.metricsMux.Lock()
+	defer a.metricsMux.Unlock()
+	a.stats[metric.Name].drift = drift
+}
+
+// collect runs a single collection cycle of the metric, collecting the
+// metrics it depends on first
+func (a *App) collect(ctx context.Context, metric MetricConfig) {
+	a.metricsMux.RLock()
+	order := a.runOrders[metric.Name]
+	a.metricsMux.RUnlock()
+
+	for _, m := range order {
+		a.collectOne(ctx, m)
+	}
+}
+
+// collectOne runs a single collection of the metric, retrying failed queries
+// and honouring the metric's circuit breaker
+func (a *App) collectOne(ctx context.Context, metric MetricConfig) {
+	// A metric that others depend on can be collected by several of them at once
+	a.metricsMux.Lock()
+	breaker := a.breakers[metric.Name]
+	stats := a.stats[metric.Name]
+	overlap := stats.running
+	stats.running = true
+	a.metricsMux.Unlock()
+
+	if overlap {
+		log.Printf("Skipping metric %s: previous collection is still running", metric.Name)
+		a.recordSkips(metric, skipOverlap, 1)
+		return
+	}
+	defer func() {
+		a.metricsMux.Lock()
+		stats.running = false
+		a.metricsMux.Unlock()
+	}()
+
+	if !breaker.Allow() {
+		log.Printf("Skipping metric %s: circuit breaker is open", metric.Name)
+		a.recordSkips(metric, skipCircuitOpen, 1)
+		return
+	}
+
+	a.collectSlots <- struct{}{}
+	defer func() { <-a.collectSlots }()
+
+	var err error
+	for attempt := 0; attempt <= a.config.CircuitBreaker.Retries; attempt++ {
+		if err = a.runQuery(ctx, metric); err == nil {
+			breaker.Success()
+			if a.config.TextfilePath != "" {
+				if err := a.writeTextfile(); err != nil {
+					log.Printf("Error writing textfile: %v", err)
+				}
+			}
+			return
+		}
+		if ctx.Err() != nil {
+			// The collector was stopped by a reload or shutdown, which
+			// isn't the query's fault
+			return
+		}
+		log.Printf("Error collecting metric %s: %v", metric.Name, err)
+	}
+
+	a.metricsMux.Lock()
+	stats.failures++
+	stats.errors++
+	stats.succeeded = false
+	a.metricsMux.Unlock()
+
+	a.notifyFailure(metric, err)
+	breaker.Failure()
+	if breaker.State() == breakerOpen {
+		log.Printf("Circuit breaker for metric %s is open", metric.Name)
+	}
+}
+
+// runQuery executes the metric's query and stores the result. The query is
+// cancelled when ctx is, or once it exceeds the metric's timeout, keeping
+// the previous result.
+func (a *App) runQuery(ctx context.Context, metric MetricConfig) error {
+	queryCtx, cancel := context.WithTimeout(ctx, a.queryTimeout(metric))
+	defer cancel()
+
+	a.metricsMux.RLock()
+	stats := a.stats[metric.Name]
+	a.metricsMux.RUnlock()
+
+	start := time.Now()
+	series, err := a.query(queryCtx, a.dbFor(metric), metric, stats, metric.Query)
+	elapsed := time.Since(start)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil && queryCtx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("query timed out after %s: %w", elapsed.Round(time.Millisecond), err)
+	}
+
+	a.metricsMux.Lock()
+	defer a.metricsMux.Unlock()
+
+	// Failed queries keep the database busy too
+	a.stats[metric.Name].collections++
+	a.stats[metric.Name].queryTime += elapsed
+	a.stats[metric.Name].lastQueryTime = elapsed
+
+	// The metric may have been removed by a reload while its query ran
+	if _, ok := a.runOrders[metric.Name]; !ok {
+		return nil
+	}
+
+	// Failures are counted by the caller once retries give up
+	if err != nil {
+		return err
+	}
+	a.stats[metric.Name].failures = 0
+	a.stats[metric.Name].succeeded = true
+
+	// A result that never changes may mean the upstream data is stuck
+	checksum := resultChecksum(series)
+	if !a.stats[metric.Name].collected.IsZero() && checksum != a.stats[metric.Name].checksum {
+		a.stats[metric.Name].resultChanges++
+	}
+	a.stats[metric.Name].checksum = checksum
+
+	if metric.Delta {
+		series = a.applyDelta(metric, series)
+	}
+
+	// Start with fresh metrics for this query
+	a.metrics[metric.Name] = series
+	a.stats[metric.Name].collected = time.Now()
+
+	log.Printf("Updated metric %s with %d time series", metric.Name, len(series))
+	return nil
+}
+
+// queryTimeout returns the timeout of the metric's query, its interval
+// unless configured otherwise
+func (a *App) queryTimeout(metric MetricConfig) time.Duration {
+	if metric.AutoTimeout {
+		return time.Duration(float64(metric.Interval) * a.config.AutoTimeoutFraction)
+	}
+	if metric.Timeout <= 0 {
+		return metric.Interval
+	}
+	return metric.Timeout
+}
+
+// deleteSeries removes the stored series of the metric. Must be called with
+// metricsMux held.
+func (a *App) deleteSeries(metric MetricConfig) {
+	delete(a.metrics, metric.Name)
+}
+
+// query executes the metric's query on db with args bound to its
+// placeholders and converts the result rows to series, keyed as they are
+// stored in the metrics map. What the query reveals about the metric, like
+// a schema mismatch or clamped values, is recorded in stats unless it's nil,
+// so queries run outside the metric's collections don't overwrite it.
+func (a *App) query(ctx context.Context, db *sql.DB, metric MetricConfig, stats *metricStats, query string, args ...interface{}) (map[string]timeSeries, error) {
+	// A reload may have removed the metric's database
+	if db == nil {
+		return nil, fmt.Errorf("database %s is not configured", metric.Database)
+	}
+
+	// Take the connection from the pool explicitly, so waiting for the pool
+	// is told apart from the query being slow
+	start := time.Now()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting connection: %w", err)
+	}
+	defer conn.Close()
+	if stats != nil {
+		a.metricsMux.Lock()
+		stats.connAcquireTime = time.Since(start)
+		a.metricsMux.Unlock()
+	}
+
+	// The rows the query examined are read from the handler counters of its
+	// session, before and after it runs
+	if metric.TrackRowsExamined && stats != nil {
+		before, err := handlerReads(ctx, conn)
+		if err != nil {
+			return nil, fmt.Errorf("error reading handler counters: %w", err)
+		}
+		// Runs once the rows are closed, freeing the connection
+		defer func() {
+			after, err := handlerReads(ctx, conn)
+			if err != nil {
+				log.Printf("Error reading handler counters of metric %s: %v", metric.Name, err)
+				return
+			}
+			a.metricsMux.Lock()
+			stats.rowsExamined = after - before
+			a.metricsMux.Unlock()
+		}()
+	}
+
+	// Get column information
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error executing query: %w", err)
+	}
+	defer rows.Close()
+
+	// Get column names
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, fmt.Errorf("error getting columns: %w", err)
+	}
+
+	// Duplicate names would silently overwrite each other's labels
+	if columns, err = dedupeColumns(columns, metric.DuplicateColumns); err != nil {
+		return nil, err
+	}
+
+	// Catch schema changes before they shift values into labels
+	if len(metric.ExpectedColumns) > 0 {
+		mismatch := !columnsMatch(columns, metric.ExpectedColumns, metric.CheckColumnOrder)
+		if stats != nil {
+			a.metricsMux.Lock()
+			stats.schemaMismatch = mismatch
+			a.metricsMux.Unlock()
+		}
+
+		if mismatch {
+			return nil, fmt.Errorf("columns %v don't match expected columns %v", columns, metric.ExpectedColumns)
+		}
+	}
+
+	// Locate the value columns. Presence-only rows have no value column,
+	// every column is a label.
+	valueIdxs := []int{-1}
+	switch {
+	case metric.Scalar:
+		// The only column of a scalar query is the value, whatever its name
+		if len(columns) != 1 {
+			return nil, fmt.Errorf("scalar query must return a single column, got %d", len(columns))
+		}
+		valueIdxs[0] = 0
+	case len(metric.ValueColumns) > 0:
+		valueIdxs = make([]int, len(metric.ValueColumns))
+		for i, col := range metric.ValueColumns {
+			if valueIdxs[i] = columnIndex(columns, col.Column); valueIdxs[i] == -1 {
+				return nil, fmt.Errorf("query must include the value column '%s'", col.Column)
+			}
+		}
+	case !metric.PresenceOnly:
+		if valueIdxs[0] = columnIndex(columns, metric.ValueColumn); valueIdxs[0] == -1 {
+			return nil, fmt.Errorf("query must include a '%s' column", metric.ValueColumn)
+		}
+	}
+	valueColumn := make(map[int]bool, len(valueIdxs))
+	for _, idx := range valueIdxs {
+		valueColumn[idx] = true
+	}
+
+	// Locate the columns naming each row's metric, type and time
+	nameIdx, typeIdx, timestampIdx := -1, -1, -1
+	if metric.NameColumn != "" {
+		if nameIdx = columnIndex(columns, metric.NameColumn); nameIdx == -1 {
+			return nil, fmt.Errorf("query must include the name column '%s'", metric.NameColumn)
+		}
+	}
+	if metric.TypeColumn != "" {
+		if typeIdx = columnIndex(columns, metric.TypeColumn); typeIdx == -1 {
+			return nil, fmt.Errorf("query must include the type column '%s'", metric.TypeColumn)
+		}
+	}
+	if metric.TimestampColumn != "" {
+		if timestampIdx = columnIndex(columns, metric.TimestampColumn); timestampIdx == -1 {
+			return nil, fmt.Errorf("query must include the timestamp column '%s'", metric.TimestampColumn)
+		}
+	}
+
+	// Columns become labels under a valid label name, e.g. "total count"
+	// as total_count
+	labelNames := make([]string, len(columns))
+	for i, col := range columns {
+		labelNames[i] = sanitizeLabelName(col)
+		if labelNames[i] != col && !valueColumn[i] && i != nameIdx && i != typeIdx && i != timestampIdx {
+			warnSanitized(metric.Name, "label", col, labelNames[i])
+		}
+	}
+
+	// Create scan destinations
+	values := make([]interface{}, len(columns))
+	valuePtrs := make([]interface{}, len(columns))
+	for i := range values {
+		valuePtrs[i] = &values[i]
+	}
+
+	// Process each row of the result set
+	series := make(map[string]timeSeries)
+
+	source := metric.Database
+	if source == "" {
+		source = defaultDatabase
+	}
+
+	var lastKeys []string
+	var rowCount int
+	var scalarSum float64
+	histograms := make(map[string]*histogram)
+	for rows.Next() {
+		// Scan the row into values
+		if err := rows.Scan(valuePtrs...); err != nil {
+			log.Printf("Error scanning row for metric %s: %v", metric.Name, err)
+			continue
+		}
+
+		// Drop the rows the row filter rejects, keeping those it can't be
+		// evaluated on
+		if len(metric.rowFilter) > 0 {
+			row := make(map[string]string, len(columns))
+			for i, col := range columns {
+				row[col] = labelString(values[i])
+			}
+			if keep, err := metric.rowFilter.match(row); err != nil {
+				log.Printf("Error evaluating row filter of metric %s, keeping the row: %v", metric.Name, err)
+			} else if !keep {
+				continue
+			}
+		}
+
+		// Rows the filter drops don't count towards the row count checks
+		rowCount++
+
+		// Create labels
+		labels := make(map[string]string)
+		for i := range columns {
+			if valueColumn[i] || i == nameIdx || i == typeIdx || i == timestampIdx {
+				continue // Skip the value, name, type and timestamp columns
+			}
+			// Rows of a histogram's _sum and _count have no le
+			if values[i] == nil && compositeType(metric.Type) {
+				continue
+			}
+
+			labels[labelNames[i]] = labelString(values[i])
+		}
+
+		var timestamp time.Time
+		if timestampIdx != -1 {
+			var ok bool
+			if timestamp, ok = rowTimestamp(values[timestampIdx]); !ok {
+				log.Printf("Warning: skipping row for metric %s with invalid timestamp %q", metric.Name, labelString(values[timestampIdx]))
+				continue
+			}
+		}
+
+		// Static labels fill in what the row doesn't provide
+		for name, value := range metric.Labels {
+			if _, ok := labels[name]; !ok {
+				labels[name] = value
+			}
+		}
+
+		for _, col := range metric.MaskLabels {
+			col = sanitizeLabelName(col)
+			if labelValue, ok := labels[col]; ok {
+				labels[col] = maskLabelValue(labelValue, metric.MaskMode, a.config.MaskSecret)
+			}
+		}
+
+		// Tell apart otherwise identical series from different databases,
+		// unless the query returns a column of the same name
+		if _, ok := labels[a.config.SourceLabel]; a.config.SourceLabel != "" && !ok {
+			labels[a.config.SourceLabel] = source
+		}
+
+		// Rows may name their own metric and declare its type
+		name, metricType := metric.Name, ""
+		if nameIdx != -1 {
+			// A NULL name would otherwise become a metric named null
+			name = ""
+			if values[nameIdx] != nil {
+				name = labelString(values[nameIdx])
+			}
+			if name == "" {
+				log.Printf("Skipping row for metric %s without a metric name", metric.Name)
+				continue
+			}
+			if sanitized := sanitizeMetricName(name); sanitized != name {
+				warnSanitized(metric.Name, "metric", name, sanitized)
+				name = sanitized
+			}
+		}
+		if typeIdx != -1 {
+			metricType = strings.ToLower(labelString(values[typeIdx]))
+			if !rowMetricTypes[metricType] {
+				log.Printf("Skipping row for metric %s with unsupported metric type %q", metric.Name, metricType)
+				continue
+			}
+		}
+
+		var entries []timeSeries
+		for i, valueIdx := range valueIdxs {
+			var value interface{} = int64(1)
+			if valueIdx != -1 {
+				value = values[valueIdx]
+			}
+			if metric.DecimalSeparator != "" {
+				value = normalizeDecimal(value, metric.DecimalSeparator)
+			}
+			if metric.check {
+				up, ok := checkValue(value)
+				if !ok {
+					log.Printf("Skipping non-boolean value of check %s: %v", metric.Name, labelString(value))
+					continue
+				}
+				value = up
+			}
+			if metric.StringValueAsLabel && value != nil {
+				if _, ok := toFloat64(value); !ok {
+					labels["value"] = labelString(value)
+					value = int64(1)
+				}
+			}
+
+			if metric.Min != nil || metric.Max != nil {
+				a.metricsMux.Lock()
+				bounded, keep := a.checkBounds(metric, stats, value)
+				a.metricsMux.Unlock()
+				if !keep {
+					continue
+				}
+				value = bounded
+			}
+
+			// The rows of a summed scalar query add up to a single value
+			if metric.Scalar && metric.OnMultiRow == multiRowSum {
+				f, ok := toFloat64(value)
+				if !ok {
+					log.Printf("Skipping non-numeric value of scalar %s: %v", metric.Name, labelString(value))
+					continue
+				}
+				scalarSum += f
+				value = scalarSum
+			}
+
+			// Raw values are observed into the histogram of their label set
+			if len(metric.HistogramBuckets) > 0 {
+				f, ok := toFloat64(value)
+				if !ok {
+					log.Printf("Skipping non-numeric value of histogram %s: %v", metric.Name, labelString(value))
+					continue
+				}
+				key := seriesKey("", labels)
+				h, ok := histograms[key]
+				if !ok {
+					h = newHistogram(labels, len(metric.HistogramBuckets))
+					histograms[key] = h
+				}
+				h.observe(f, metric.HistogramBuckets)
+				continue
+			}
+
+			// Keep the row's own name, if it named one, alongside the value.
+			// Each of several value columns is a metric of its own.
+			entry := timeSeries{metric: metric.Name, metricType: metricType, labels: labels, value: value, timestamp: timestamp}
+			if nameIdx != -1 {
+				entry.name = name
+			} else if len(metric.ValueColumns) > 0 {
+				entry.name = metric.MetricName + "_" + metric.ValueColumns[i].Column
+			}
+			entries = append(entries, entry)
+		}
+		if len(entries) == 0 {
+			continue
+		}
+
+		// A latest-value query only keeps a single row
+		if metric.LatestRowOnly {
+			for _, key := range lastKeys {
+				delete(series, key)
+			}
+			lastKeys = lastKeys[:0]
+		}
+		for _, entry := range entries {
+			key := entry.key()
+			series[key] = entry
+			lastKeys = append(lastKeys, key)
+		}
+
+		// The rows of a scalar query share a series, so later rows replace
+		// earlier ones unless only the first is wanted
+		if (metric.LatestRowOnly && metric.LatestRow == latestRowFirst) || (metric.Scalar && metric.OnMultiRow == multiRowFirst) {
+			break
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	if metric.Scalar && metric.OnMultiRow == multiRowError && rowCount > 1 {
+		return nil, fmt.Errorf("scalar query must return a single row, got %d", rowCount)
+	}
+
+	for _, h := range histograms {
+		for key, s := range h.series(metric) {
+			series[key] = s
+		}
+	}
+
+	if metric.MinRows != nil || metric.MaxRows != nil {
+		outOfRange := (metric.MinRows != nil && rowCount < *metric.MinRows) ||
+			(metric.MaxRows != nil && rowCount > *metric.MaxRows)
+		if outOfRange {
+			log.Printf("Metric %s returned %d rows, outside its expected range", metric.Name, rowCount)
+		}
+		if stats != nil {
+			a.metricsMux.Lock()
+			stats.rowCountOutOfRange = outOfRange
+			a.metricsMux.Unlock()
+		}
+	}
+
+	return series, nil
+}
+
+// metricTypes are the types a metric may be configured with
+var metricTypes = map[string]bool{
+	"gauge":     true,
+	"counter":   true,
+	"histogram": true,
+	"summary":   true,
+}
+
+// boundLabels are the labels holding the bound of a histogram bucket or a
+// summary quantile
+var boundLabels = []string{"le", "quantile"}
+
+// compositeType reports whether series of the metric type are rendered from
+// several differently named samples, like a histogram's _bucket, _sum and
+// _count
+func compositeType(metricType string) bool {
+	return metricType == "histogram" || metricType == "summary"
+}
+
+// rowMetricTypes are the metric types a query row may declare
+var rowMetricTypes = map[string]bool{
+	"gauge":   true,
+	"counter": true,
+	"untyped": true,
+}
+
+// metricNameRegexp matches valid Prometheus metric names
+var metricNameRegexp = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// validMetricName reports whether name is a valid Prometheus metric name
+func validMetricName(name string) bool {
+	return metricNameRegexp.MatchString(name)
+}
+
+// labelNameRegexp matches valid Prometheus label names
+var labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// columnsMatch reports whether columns has the same names as expected, and
+// in the same order if ordered is set
+func columnsMatch(columns, expected []string, ordered bool) bool {
+	if len(columns) != len(expected) {
+		return false
+	}
+
+	if !ordered {
+		columns = append([]string(nil), columns...)
+		expected = append([]string(nil), expected...)
+		sort.Strings(columns)
+		sort.Strings(expected)
+	}
+
+	for i := range columns {
+		if columns[i] != expected[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// dedupeColumns checks columns for duplicate names, renaming all but the
+// first column of a name to name_<index> in rename mode
+func dedupeColumns(columns []string, mode string) ([]string, error) {
+	seen := make(map[string]bool)
+	for _, col := range columns {
+		seen[col] = false
+	}
+	var deduped []string
+	for i, col := range columns {
+		if !seen[col] {
+			seen[col] = true
+			continue
+		}
+		if mode != duplicateColumnsRename {
+			return nil, fmt.Errorf("query returns column '%s' more than once", col)
+		}
+		if deduped == nil {
+			deduped = append([]string(nil), columns...)
+		}
+		// The new name may not be taken by another column either
+		renamed := fmt.Sprintf("%s_%d", col, i)
+		if _, taken := seen[renamed]; taken {
+			return nil, fmt.Errorf("query returns column '%s' more than once, and can't rename it to the existing '%s'", col, renamed)
+		}
+		seen[renamed] = true
+		deduped[i] = renamed
+	}
+
+	if deduped == nil {
+		return columns, nil
+	}
+	return deduped, nil
+}
+
+// columnIndex returns the index of the named column, or -1 if it is missing
+func columnIndex(columns []string, name string) int {
+	for i, col := range columns {
+		if col == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// labelString converts a raw query value to a label value
+func labelString(value interface{}) string {
+	if value == nil {
+		return "null"
+	}
+
+	switch v := value.(type) {
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+// maskLabelValue hides a sensitive label value. Hashing keeps distinct values
+// distinct and stable across collections without exposing the original, and
+// keying the hash with secret stops guessed values from being checked against
+// it.
+func maskLabelValue(value, mode, secret string) string {
+	if mode == maskModePlaceholder {
+		return maskPlaceholder
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// checkBounds applies the metric's Min/Max bounds to value, returning the value
+// to store and whether the row should be kept, and counts it in stats when
+// clamped or rejected unless stats is nil. Must be called with metricsMux held.
+func (a *App) checkBounds(metric MetricConfig, stats *metricStats, value interface{}) (interface{}, bool) {
+	f, ok := toFloat64(value)
+	if !ok {
+		// Non-numeric values are dealt with when rendering
+		return value, true
+	}
+
+	bounded := f
+	if metric.Min != nil && f < *metric.Min {
+		bounded = *metric.Min
+	}
+	if metric.Max != nil && f > *metric.Max {
+		bounded = *metric.Max
+	}
+	if bounded == f {
+		return value, true
+	}
+
+	if stats != nil {
+		stats.clamped++
+	}
+	if metric.ClampMode == clampModeReject {
+		log.Printf("Rejecting implausible value %g for metric %s", f, metric.Name)
+		return nil, false
+	}
+
+	log.Printf("Clamping implausible value %g for metric %s to %g", f, metric.Name, bounded)
+	return bounded, true
+}
+
+// seriesKey returns the canonical identity of a series: its name followed by
+// its labels sorted by name, in exposition format, e.g.
+// queue_depth{queue="emails",region="eu"}. It doesn't depend on the order of
+// the query's columns, and unlike joining names and values with underscores
+// distinct label sets can't collide.
+func seriesKey(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteString("{")
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString(k)
+		b.WriteString("=\"")
+		b.WriteString(escapeLabelValue(labels[k]))
+		b.WriteString("\"")
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+// handleMetrics handles the /metrics endpoint for Prometheus
+func (a *App) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if a.rejectIfShuttingDown(w) {
+		return
+	}
+	now := time.Now()
+	a.lastScrape.Store(now.UnixNano())
+
+	scraped, err := a.scrapeSeries(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	a.metricsMux.RLock()
+	defer a.metricsMux.RUnlock()
+
+	series := a.currentSeries(outputScrape)
+	for name, value := range scraped {
+		series[name] = value
+	}
+	a.stampSeries(series, now)
+
+	// Render into a buffer, so the body can be compressed as a whole
+	var body bytes.Buffer
+	openMetrics := negotiateFormat(w, r)
+	a.writeSeries(&body, series, openMetrics)
+	a.writeSelfMetrics(&body, openMetrics)
+
+	if openMetrics {
+		fmt.Fprint(&body, "# EOF\n")
+	}
+	writeBody(w, r, body.Bytes())
+}
+
+// negotiateFormat sets the response content type, returning whether the
+// scraper asked for OpenMetrics, which gets unit metadata
+func negotiateFormat(w http.ResponseWriter, r *http.Request) bool {
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	if openMetrics {
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "text/plain")
+	}
+	return openMetrics
+}
+
+// writeSeries writes series in Prometheus format. Must be called with
+// metricsMux held.
+func (a *App) writeSeries(w io.Writer, series map[string]timeSeries, openMetrics bool) {
+	rendered := a.renderFamilies(series, openMetrics)
+
+	familyNames := make([]string, 0, len(rendered))
+	for name := range rendered {
+		familyNames = append(familyNames, name)
+	}
+	sort.Strings(familyNames)
+
+	for _, name := range familyNames {
+		fmt.Fprint(w, rendered[name])
+	}
+}
+
+// renderFamilies renders series in Prometheus format, returning the text of
+// each metric family by name. Must be called with metricsMux held.
+func (a *App) renderFamilies(series map[string]timeSeries, openMetrics bool) map[string]string {
+	// Group series into families so each family gets a single HELP/TYPE
+	type sample struct {
+		// order and bound sort the samples, bound being the numeric value
+		// of an le or quantile label
+		order string
+		bound float64
+		line  string
+	}
+	type family struct {
+		help       string
+		metricType string
+		unit       string
+		samples    []sample
+	}
+	families := make(map[string]*family)
+
+	for _, s := range series {
+		// Resolve the name the series is exposed under
+		baseName, unit, valueFormat, metricType, help := s.metric, "", valueFormatAuto, "gauge", ""
+		metric, known := a.metricConfig(s.metric)
+		if known {
+			baseName, unit, valueFormat, metricType = metric.MetricName, metric.Unit, metric.ValueFormat, metric.Type
+		}
+
+		// Rows that named their own metric carry the name and type, except
+		// that the samples of a histogram or summary stay in its family
+		sampleName := baseName
+		if s.name != "" {
+			sampleName = s.name
+			if !compositeType(metricType) {
+				baseName, unit = s.name, ""
+			}
+		}
+		// Value columns may describe the metrics they are exposed as
+		if col, ok := metric.valueColumn(s.name); known && ok {
+			help, unit = col.Help, col.Unit
+			if col.Type != "" {
+				metricType = col.Type
+			}
+		}
+		if s.metricType != "" {
+			metricType = s.metricType
+		}
+
+		rawValue, labels := s.value, s.labels
+		floatValue, ok := toFloat64(rawValue)
+		if !ok {
+			// Skip non-numeric values
+			log.Printf("Skipping non-numeric metric %s with value type %T: %v", baseName, rawValue, rawValue)
+			continue
+		}
+
+		// The entries of a family agree on its type and unit, as Validate
+		// checks, so any of its series can describe it
+		fam, ok := families[baseName]
+		if !ok {
+			fam = &family{help: help, metricType: metricType, unit: unit}
+			families[baseName] = fam
+		}
+
+		// Format the metric line, its series key carries the labels
+		value := formatValue(rawValue, floatValue, valueFormat)
+		if !s.timestamp.IsZero() {
+			value += " " + formatTimestamp(s.timestamp, openMetrics)
+		}
+		line := fmt.Sprintf("%s %s\n", seriesKey(sampleName, labels), value)
+
+		// Order buckets and quantiles by their numeric bound, not as text
+		order, bound := seriesKey(sampleName, labels), 0.0
+		for _, name := range boundLabels {
+			if f, err := strconv.ParseFloat(labels[name], 64); err == nil {
+				order, bound = seriesKey(sampleName, withoutLabel(labels, name)), f
+			}
+		}
+		fam.samples = append(fam.samples, sample{order: order, bound: bound, line: line})
+	}
+
+	// Render metrics in Prometheus format
+	rendered := make(map[string]string, len(families))
+	for name, fam := range families {
+		var b strings.Builder
+		help, metricType, unit := "Value from custom SQL query", fam.metricType, fam.unit
+		if fam.help != "" {
+			help = fam.help
+		}
+		if md, ok := a.metadata[name]; ok {
+			if md.help != "" {
+				help = md.help
+			}
+			if md.metricType != "" {
+				metricType = md.metricType
+			}
+			if md.unit != "" {
+				unit = md.unit
+			}
+		}
+		writeMetricHeader(&b, name, help, metricType, unit, openMetrics)
+
+		sort.Slice(fam.samples, func(i, j int) bool {
+			si, sj := fam.samples[i], fam.samples[j]
+			if si.order != sj.order {
+				return si.order < sj.order
+			}
+			if si.bound != sj.bound {
+				return si.bound < sj.bound
+			}
+			return si.line < sj.line
+		})
+		for _, sample := range fam.samples {
+			b.WriteString(sample.line)
+		}
+		rendered[name] = b.String()
+	}
+	return rendered
+}
+
+// currentSeries returns a copy of the stored series that aren't stale and
+// are routed to output. Must be called with metricsMux held.
+func (a *App) currentSeries(output string) map[string]timeSeries {
+	series := make(map[string]timeSeries)
+	for _, metricSeries := range a.metrics {
+		for key, s := range metricSeries {
+			if a.isStale(s) || !a.routedTo(s, output) {
+				continue
+			}
+			series[key] = s
+		}
+	}
+	return series
+}
+
+// routedTo reports whether the series' metric sends it to output. Metrics
+// without a configured output send their series everywhere. Must be called
+// with metricsMux held.
+func (a *App) routedTo(s timeSeries, output string) bool {
+	metric, ok := a.metricConfig(s.metric)
+	return !ok || metric.Output == "" || metric.Output == output
+}
+
+// isStale reports whether the series belongs to a metric that has gone
+// without a successful collection for longer than its collection interval
+// plus its StaleAfter grace period. Must be called with metricsMux held.
+func (a *App) isStale(s timeSeries) bool {
+	metric, ok := a.metricConfig(s.metric)
+	if !ok || metric.StaleAfter <= 0 {
+		return false
+	}
+
+	interval := metric.Interval
+	if metric.SampleEvery > 1 {
+		interval *= time.Duration(metric.SampleEvery)
+	}
+	return time.Since(a.stats[metric.Name].collected) > interval+metric.StaleAfter
+}
+
+// scrapeSeries runs the on-scrape metrics, binding the parameters passed as
+// param_<name> in the scrape URL. A metric only runs when the scrape passes
+// every one of its parameters, and parameters no metric allows are an error.
+func (a *App) scrapeSeries(r *http.Request) (map[string]timeSeries, error) {
+	metrics := a.metricConfigs()
+
+	allowed := make(map[string]bool)
+	for _, metric := range metrics {
+		for _, param := range metric.Params {
+			allowed[param] = true
+		}
+	}
+
+	params := make(map[string]string)
+	for key, values := range r.URL.Query() {
+		name, ok := strings.CutPrefix(key, "param_")
+		if !ok {
+			continue
+		}
+		if !allowed[name] {
+			return nil, fmt.Errorf("unknown parameter %s", name)
+		}
+		params[name] = values[0]
+	}
+
+	series := make(map[string]timeSeries)
+	for _, metric := range metrics {
+		if !metric.OnScrape || !hasParams(params, metric.Params) {
+			continue
+		}
+
+		// A parameterised run only answers this scrape, so like a probe it
+		// leaves the metric's statistics alone
+		var stats *metricStats
+		if len(metric.Params) == 0 {
+			a.metricsMux.RLock()
+			stats = a.stats[metric.Name]
+			a.metricsMux.RUnlock()
+		}
+
+		query, args := bindParams(metric.Query, metric.Params, params, a.driverFor(metric) == "postgres")
+		metricSeries, err := a.query(r.Context(), a.dbFor(metric), metric, stats, query, args...)
+		if err != nil {
+			log.Printf("Error collecting metric %s: %v", metric.Name, err)
+			continue
+		}
+		for k, v := range metricSeries {
+			series[k] = v
+		}
+	}
+	return series, nil
+}
+
+// hasParams reports whether params has a value for every name
+func hasParams(params map[string]string, names []string) bool {
+	for _, name := range names {
+		if _, ok := params[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// bindParams replaces the :name placeholders in query for each of the names
+// with a positional placeholder, ? or $1, $2... when numbered is set,
+// returning the values to bind in order. Values are never spliced into the
+// query, and placeholders inside strings, quoted identifiers, comments or
+// :: casts are left alone.
+func bindParams(query string, names []string, params map[string]string, numbered bool) (string, []interface{}) {
+	bound := make(map[string]bool)
+	for _, name := range names {
+		bound[name] = true
+	}
+
+	var b strings.Builder
+	var args []interface{}
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case isQuote(c) || isComment(query, i):
+			// Copied as they are, up to the end of the query if unterminated
+			var j int
+			if isQuote(c) {
+				j = quoteEnd(query, i)
+			} else {
+				j = commentEnd(query, i)
+			}
+			if j == -1 {
+				j = len(query)
+			}
+			b.WriteString(query[i:j])
+			i = j - 1
+			continue
+		case c == ':' && (i == 0 || query[i-1] != ':'):
+			j := i + 1
+			for j < len(query) && isIdentByte(query[j]) {
+				j++
+			}
+			if name := query[i+1 : j]; bound[name] {
+				args = append(args, params[name])
+				if numbered {
+					fmt.Fprintf(&b, "$%d", len(args))
+				} else {
+					b.WriteByte('?')
+				}
+				i = j - 1
+				continue
+			}
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), args
+}
+
+// isIdentByte reports whether c may appear in a placeholder name
+func isIdentByte(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+// metricConfig returns the config of the named metric
+func (a *App) metricConfig(name string) (MetricConfig, bool) {
+	for _, metric := range a.config.Metrics {
+		if metric.Name == name {
+			return metric, true
+		}
+	}
+	return MetricConfig{}, false
+}
+
+// writeMetricHeader writes the HELP and TYPE lines of a metric family, plus
+// the UNIT line in OpenMetrics output
+func writeMetricHeader(w io.Writer, name, help, metricType, unit string, openMetrics bool) {
+	if openMetrics {
+		switch metricType {
+		case "counter":
+			// OpenMetrics counter families are named without the _total suffix
+			name = strings.TrimSuffix(name, "_total")
+		case "untyped":
+			metricType = "unknown"
+		}
 	}
-	defer rows.Close()
 
-	// Get column names
-	columns, err := rows.Columns()
-	if err != nil {
-		log.Printf("Error getting columns for metric %s: %v", metric.Name, err)
-		return
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, metricType)
+	if openMetrics && unit != "" {
+		fmt.Fprintf(w, "# UNIT %s %s\n", name, unit)
 	}
+}
 
-	// Prepare values slice for scanning
-	valueIdx := -1
-	for i, col := range columns {
-		if col == "value" {
-			valueIdx = i
-			break
+// hasUnitSuffix reports whether a metric name follows the convention of
+// ending in its unit, before any _total suffix
+func hasUnitSuffix(name, unit string) bool {
+	return strings.HasSuffix(strings.TrimSuffix(name, "_total"), "_"+unit)
+}
+
+// writeSelfMetrics writes the exporter's own metrics. Must be called with
+// metricsMux held.
+func (a *App) writeSelfMetrics(w io.Writer, openMetrics bool) {
+	if a.config.CircuitBreaker.Threshold > 0 {
+		writeMetricHeader(w, "sqlmetrics_circuit_breaker_state",
+			"State of the metric's circuit breaker (0=closed, 1=half-open, 2=open)", "gauge", "", openMetrics)
+		for _, metric := range a.config.Metrics {
+			fmt.Fprintf(w, "sqlmetrics_circuit_breaker_state{metric=\"%s\"} %d\n",
+				escapeLabelValue(metric.Name), a.breakers[metric.Name].State())
 		}
 	}
 
-	if valueIdx == -1 {
-		log.Printf("Error: metric %s query must include a 'value' column", metric.Name)
-		return
+	first := true
+	for _, metric := range a.config.Metrics {
+		if metric.Min == nil && metric.Max == nil {
+			continue
+		}
+		if first {
+			writeMetricHeader(w, "sqlmetrics_clamped_total",
+				"Number of values outside the metric's bounds", "counter", "", openMetrics)
+			first = false
+		}
+		fmt.Fprintf(w, "sqlmetrics_clamped_total{metric=\"%s\"} %d\n",
+			escapeLabelValue(metric.Name), a.stats[metric.Name].clamped)
 	}
 
-	// Create scan destinations
-	values := make([]interface{}, len(columns))
-	valuePtrs := make([]interface{}, len(columns))
-	for i := range values {
-		valuePtrs[i] = &values[i]
+	first = true
+	for _, metric := range a.config.Metrics {
+		if len(metric.ExpectedColumns) == 0 {
+			continue
+		}
+		if first {
+			writeMetricHeader(w, "sqlmetrics_schema_mismatch",
+				"Whether the query's columns differ from the expected columns", "gauge", "", openMetrics)
+			first = false
+		}
+		mismatch := 0
+		if a.stats[metric.Name].schemaMismatch {
+			mismatch = 1
+		}
+		fmt.Fprintf(w, "sqlmetrics_schema_mismatch{metric=\"%s\"} %d\n", escapeLabelValue(metric.Name), mismatch)
 	}
 
-	// Process each row of the result set
-	a.metricsMux.Lock()
-	defer a.metricsMux.Unlock()
-
-	// Start with fresh metrics for this query
-	// Use a prefix to identify metrics from this query
-	prefix := metric.Name + "_"
-	// First remove any existing metrics with this prefix
-	for k := range a.metrics {
-		if len(k) >= len(prefix) && k[:len(prefix)] == prefix {
-			delete(a.metrics, k)
+	first = true
+	for _, metric := range a.config.Metrics {
+		if metric.MinRows == nil && metric.MaxRows == nil {
+			continue
 		}
+		if first {
+			writeMetricHeader(w, "sqlmetrics_rowcount_out_of_range",
+				"Whether the query's row count is outside its expected range", "gauge", "", openMetrics)
+			first = false
+		}
+		outOfRange := 0
+		if a.stats[metric.Name].rowCountOutOfRange {
+			outOfRange = 1
+		}
+		fmt.Fprintf(w, "sqlmetrics_rowcount_out_of_range{metric=\"%s\"} %d\n", escapeLabelValue(metric.Name), outOfRange)
 	}
 
-	for rows.Next() {
-		// Scan the row into values
-		if err := rows.Scan(valuePtrs...); err != nil {
-			log.Printf("Error scanning row for metric %s: %v", metric.Name, err)
+	first = true
+	for _, metric := range a.config.Metrics {
+		if !metric.TrackRowsExamined {
 			continue
 		}
+		if first {
+			writeMetricHeader(w, "sqlmetrics_query_rows_examined",
+				"Number of rows the metric's last query read, per the database's handler counters", "gauge", "", openMetrics)
+			first = false
+		}
+		fmt.Fprintf(w, "sqlmetrics_query_rows_examined{metric=\"%s\"} %d\n",
+			escapeLabelValue(metric.Name), a.stats[metric.Name].rowsExamined)
+	}
 
-		// Create labels
-		labels := make(map[string]string)
-		for i, col := range columns {
-			if i == valueIdx {
-				continue // Skip the value column
-			}
-
-			// Convert the value to string for label
-			var labelValue string
-			if values[i] == nil {
-				labelValue = "null"
-			} else {
-				switch v := values[i].(type) {
-				case []byte:
-					labelValue = string(v)
-				default:
-					labelValue = fmt.Sprintf("%v", v)
-				}
-			}
+	writeMetricHeader(w, "sqlmetrics_consecutive_failures",
+		"Number of the metric's collections that failed in a row", "gauge", "", openMetrics)
+	for _, metric := range a.config.Metrics {
+		fmt.Fprintf(w, "sqlmetrics_consecutive_failures{metric=\"%s\"} %d\n",
+			escapeLabelValue(metric.Name), a.stats[metric.Name].failures)
+	}
 
-			labels[col] = labelValue
+	writeMetricHeader(w, "sqlmetrics_query_skipped_total",
+		"Number of the metric's collections that were skipped, by reason", "counter", "", openMetrics)
+	for _, metric := range a.config.Metrics {
+		for _, reason := range skipReasons {
+			fmt.Fprintf(w, "sqlmetrics_query_skipped_total{metric=\"%s\",reason=\"%s\"} %d\n",
+				escapeLabelValue(metric.Name), reason, a.stats[metric.Name].skipped[reason])
 		}
+	}
 
-		// Create a unique metric name with labels
-		if len(labels) > 0 {
-			metricKeyName := prefix + buildLabelsKey(labels)
-			a.metrics[metricKeyName] = map[string]interface{}{
-				"value":  values[valueIdx],
-				"labels": labels,
-			}
-		} else {
-			// If no labels, use the metric name directly
-			a.metrics[metric.Name] = values[valueIdx]
-		}
+	writeMetricHeader(w, "sqlmetrics_query_duration_seconds_total",
+		"Total time spent running the metric's query", "counter", "seconds", openMetrics)
+	for _, metric := range a.config.Metrics {
+		fmt.Fprintf(w, "sqlmetrics_query_duration_seconds_total{metric=\"%s\"} %g\n",
+			escapeLabelValue(metric.Name), a.stats[metric.Name].queryTime.Seconds())
 	}
 
-	if err := rows.Err(); err != nil {
-		log.Printf("Error iterating rows for metric %s: %v", metric.Name, err)
+	writeMetricHeader(w, "sqlmetrics_query_last_duration_seconds",
+		"Time the last run of the metric's query took", "gauge", "seconds", openMetrics)
+	for _, metric := range a.config.Metrics {
+		fmt.Fprintf(w, "sqlmetrics_query_last_duration_seconds{metric=\"%s\"} %g\n",
+			escapeLabelValue(metric.Name), a.stats[metric.Name].lastQueryTime.Seconds())
 	}
 
-	log.Printf("Updated metric %s with %d time series", metric.Name, 1)
-}
+	writeMetricHeader(w, "sqlmetrics_conn_acquire_seconds",
+		"Time the metric's last query waited for a connection from the pool", "gauge", "seconds", openMetrics)
+	for _, metric := range a.config.Metrics {
+		fmt.Fprintf(w, "sqlmetrics_conn_acquire_seconds{metric=\"%s\"} %g\n",
+			escapeLabelValue(metric.Name), a.stats[metric.Name].connAcquireTime.Seconds())
+	}
 
-// buildLabelsKey creates a stable key from labels map
-func buildLabelsKey(labels map[string]string) string {
-	// Sort keys for stability
-	keys := make([]string, 0, len(labels))
-	for k := range labels {
-		keys = append(keys, k)
+	writeMetricHeader(w, "sqlmetrics_query_errors_total",
+		"Number of the metric's collections that failed after retries", "counter", "", openMetrics)
+	for _, metric := range a.config.Metrics {
+		fmt.Fprintf(w, "sqlmetrics_query_errors_total{metric=\"%s\"} %d\n",
+			escapeLabelValue(metric.Name), a.stats[metric.Name].errors)
 	}
-	sort.Strings(keys)
 
-	// Build key
-	var b strings.Builder
-	for i, k := range keys {
-		if i > 0 {
-			b.WriteString("_")
+	writeMetricHeader(w, "sqlmetrics_last_query_success",
+		"Whether the metric's last query succeeded", "gauge", "", openMetrics)
+	for _, metric := range a.config.Metrics {
+		success := 0
+		if a.stats[metric.Name].succeeded {
+			success = 1
 		}
-		b.WriteString(k)
-		b.WriteString("_")
-		b.WriteString(labels[k])
+		fmt.Fprintf(w, "sqlmetrics_last_query_success{metric=\"%s\"} %d\n",
+			escapeLabelValue(metric.Name), success)
 	}
-	return b.String()
-}
-
-// handleMetrics handles the /metrics endpoint for Prometheus
-func (a *App) handleMetrics(w http.ResponseWriter, r *http.Request) {
-	a.metricsMux.RLock()
-	defer a.metricsMux.RUnlock()
 
-	w.Header().Set("Content-Type", "text/plain")
-
-	// Write metrics in Prometheus format
-	for name, value := range a.metrics {
-		var floatValue float64
-		var labels map[string]string
-
-		// Check if this is a labeled metric or a direct value
-		if metricMap, ok := value.(map[string]interface{}); ok {
-			// Get the value and labels from the map
-			rawValue := metricMap["value"]
-			if rawLabels, ok := metricMap["labels"].(map[string]string); ok {
-				labels = rawLabels
-			}
-
-			// Convert value to float64
-			switch v := rawValue.(type) {
-			case int:
-				floatValue = float64(v)
-			case int32:
-				floatValue = float64(v)
-			case int64:
-				floatValue = float64(v)
-			case uint:
-				floatValue = float64(v)
-			case uint32:
-				floatValue = float64(v)
-			case uint64:
-				floatValue = float64(v)
-			case float32:
-				floatValue = float64(v)
-			case float64:
-				floatValue = v
-			case []byte:
-				// Try to parse as float
-				if f, err := strconv.ParseFloat(string(v), 64); err == nil {
-					floatValue = f
-				} else {
-					// Skip non-numeric values
-					log.Printf("Skipping non-numeric metric %s with value %v", name, v)
-					continue
-				}
-			default:
-				// Skip non-numeric values
-				log.Printf("Skipping non-numeric metric %s with value type %T: %v", name, rawValue, rawValue)
-				continue
-			}
-		} else {
-			// Direct value (no labels)
-			switch v := value.(type) {
-			case int:
-				floatValue = float64(v)
-			case int32:
-				floatValue = float64(v)
-			case int64:
-				floatValue = float64(v)
-			case uint:
-				floatValue = float64(v)
-			case uint32:
-				floatValue = float64(v)
-			case uint64:
-				floatValue = float64(v)
-			case float32:
-				floatValue = float64(v)
-			case float64:
-				floatValue = v
-			case []byte:
-				// Try to parse as float
-				if f, err := strconv.ParseFloat(string(v), 64); err == nil {
-					floatValue = f
-				} else {
-					// Skip non-numeric values
-					log.Printf("Skipping non-numeric metric %s with value %v", name, v)
-					continue
-				}
-			default:
-				// Skip non-numeric values
-				log.Printf("Skipping non-numeric metric %s with value type %T: %v", name, value, value)
-				continue
-			}
-		}
+	writeMetricHeader(w, "sqlmetrics_result_changes_total",
+		"Number of the metric's queries whose result differed from the previous one", "counter", "", openMetrics)
+	for _, metric := range a.config.Metrics {
+		fmt.Fprintf(w, "sqlmetrics_result_changes_total{metric=\"%s\"} %d\n",
+			escapeLabelValue(metric.Name), a.stats[metric.Name].resultChanges)
+	}
 
-		// Extract the base metric name (remove prefix and label encoding)
-		baseName := name
-		if idx := strings.Index(name, "_"); idx > 0 {
-			baseName = name[:idx]
-		}
+	writeMetricHeader(w, "sqlmetrics_schedule_drift_seconds",
+		"Delay between a collection's scheduled and actual start", "gauge", "seconds", openMetrics)
+	for _, metric := range a.config.Metrics {
+		fmt.Fprintf(w, "sqlmetrics_schedule_drift_seconds{metric=\"%s\"} %g\n",
+			escapeLabelValue(metric.Name), a.stats[metric.Name].drift.Seconds())
+	}
+}
 
-		fmt.Fprintf(w, "# HELP %s Value from custom SQL query\n", baseName)
-		fmt.Fprintf(w, "# TYPE %s gauge\n", baseName)
+// toFloat64 converts a raw query value to float64, reporting whether the
+// value is numeric
+func toFloat64(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	case []byte:
+		// Try to parse as float
+		f, err := strconv.ParseFloat(string(v), 64)
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
 
-		// Format the metric line with labels if they exist
-		if labels != nil && len(labels) > 0 {
-			// Build the label string
-			var labelStr strings.Builder
-			labelStr.WriteString("{")
+// normalizeDecimal replaces sep in a value returned as text with a decimal
+// point, so it parses as a number. Other values are returned unchanged.
+func normalizeDecimal(value interface{}, sep string) interface{} {
+	switch v := value.(type) {
+	case []byte:
+		return []byte(strings.Replace(string(v), sep, ".", 1))
+	case string:
+		return strings.Replace(v, sep, ".", 1)
+	default:
+		return value
+	}
+}
 
-			first := true
-			for k, v := range labels {
-				if !first {
-					labelStr.WriteString(",")
-				}
-				first = false
-				labelStr.WriteString(k)
-				labelStr.WriteString("=\"")
-				labelStr.WriteString(escapeLabelValue(v))
-				labelStr.WriteString("\"")
-			}
-			labelStr.WriteString("}")
+// formatValue renders a sample value according to the metric's value format.
+// Integer sources are rendered exactly, without the precision loss of going
+// through float64.
+func formatValue(raw interface{}, f float64, format string) string {
+	switch format {
+	case valueFormatInt:
+		if s, ok := exactInteger(raw); ok {
+			return s
+		}
+		return strconv.FormatFloat(math.Round(f), 'f', 0, 64)
+	case valueFormatFloat:
+		s := strconv.FormatFloat(f, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".eIN") {
+			// Always render a decimal point
+			s += ".0"
+		}
+		return s
+	default:
+		if s, ok := exactInteger(raw); ok {
+			return s
+		}
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+}
 
-			fmt.Fprintf(w, "%s%s %g\n", baseName, labelStr.String(), floatValue)
-		} else {
-			fmt.Fprintf(w, "%s %g\n", baseName, floatValue)
+// exactInteger renders raw as an integer if it is one
+func exactInteger(raw interface{}) (string, bool) {
+	switch v := raw.(type) {
+	case int:
+		return strconv.Itoa(v), true
+	case int32:
+		return strconv.FormatInt(int64(v), 10), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case uint:
+		return strconv.FormatUint(uint64(v), 10), true
+	case uint32:
+		return strconv.FormatUint(uint64(v), 10), true
+	case uint64:
+		return strconv.FormatUint(v, 10), true
+	case []byte:
+		if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			return strconv.FormatInt(i, 10), true
+		}
+		if u, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			return strconv.FormatUint(u, 10), true
 		}
 	}
+	return "", false
 }
 
 // escapeLabelValue escapes special characters in label values
@@ -361,6 +2433,11 @@ func escapeLabelValue(value string) string {
 
 // handleMetricsJSON handles the /metrics.json endpoint
 func (a *App) handleMetricsJSON(w http.ResponseWriter, r *http.Request) {
+	if a.rejectIfShuttingDown(w) {
+		return
+	}
+	a.lastScrape.Store(time.Now().UnixNano())
+
 	a.metricsMux.RLock()
 	defer a.metricsMux.RUnlock()
 
@@ -369,12 +2446,27 @@ func (a *App) handleMetricsJSON(w http.ResponseWriter, r *http.Request) {
 	// Create a response structure that's more JSON-friendly
 	response := make(map[string]interface{})
 
-	for name, value := range a.metrics {
-		if metricMap, ok := value.(map[string]interface{}); ok {
+	// The series of entries sharing a metric name are listed together, each
+	// keyed by its entry, so unlabeled ones don't overwrite each other
+	entries := make(map[string]int)
+	for _, metric := range a.config.Metrics {
+		entries[metric.MetricName]++
+	}
+
+	for _, s := range a.currentSeries(outputScrape) {
+		metric, known := a.metricConfig(s.metric)
+
+		name := s.metric
+		if known {
+			name = metric.MetricName
+		}
+		shared := known && entries[name] > 1
+
+		if s.grouped() || shared {
 			// For metrics with labels, restructure them in a more JSON-friendly way
 			baseName := name
-			if idx := strings.Index(name, "_"); idx > 0 {
-				baseName = name[:idx]
+			if s.name != "" {
+				baseName = s.name
 			}
 
 			// Group metrics by base name
@@ -386,51 +2478,421 @@ func (a *App) handleMetricsJSON(w http.ResponseWriter, r *http.Request) {
 			}
 
 			// Add this metric to the group
-			metrics = append(metrics, map[string]interface{}{
-				"value":  metricMap["value"],
-				"labels": metricMap["labels"],
-			})
+			series := map[string]interface{}{
+				"value":  s.value,
+				"labels": s.labels,
+			}
+			if a.config.ExposeQueries && known {
+				series["query"] = metric.Query
+			}
+			if !s.timestamp.IsZero() {
+				series["timestamp"] = s.timestamp
+			}
+			if shared {
+				series["metric"] = s.metric
+			}
+			metrics = append(metrics, series)
 
 			response[baseName] = metrics
+		} else if (a.config.ExposeQueries && known) || !s.timestamp.IsZero() {
+			// Direct values need an object to carry the query or timestamp
+			value := map[string]interface{}{
+				"value": s.value,
+			}
+			if a.config.ExposeQueries && known {
+				value["query"] = metric.Query
+			}
+			if !s.timestamp.IsZero() {
+				value["timestamp"] = s.timestamp
+			}
+			response[name] = value
 		} else {
 			// For direct values, just add them directly
-			response[name] = value
+			response[name] = s.value
+		}
+	}
+
+	// Sort grouped series so identical snapshots encode identically
+	for _, value := range response {
+		if metrics, ok := value.([]map[string]interface{}); ok {
+			sort.Slice(metrics, func(i, j int) bool {
+				labelsI, _ := metrics[i]["labels"].(map[string]string)
+				labelsJ, _ := metrics[j]["labels"].(map[string]string)
+				if keyI, keyJ := seriesKey("", labelsI), seriesKey("", labelsJ); keyI != keyJ {
+					return keyI < keyJ
+				}
+				metricI, _ := metrics[i]["metric"].(string)
+				metricJ, _ := metrics[j]["metric"].(string)
+				return metricI < metricJ
+			})
+		}
+	}
+
+	body, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error encoding metrics: %v", err), http.StatusInternalServerError)
+		return
+	}
+	body = append(body, '\n')
+
+	// Let pollers skip unchanged snapshots. The gzipped and plain bodies
+	// differ, so each gets its own ETag.
+	sum := sha256.Sum256(body)
+	etag := hex.EncodeToString(sum[:16])
+	if acceptsGzip(r.Header.Get("Accept-Encoding")) {
+		etag += "-gzip"
+	}
+	etag = `"` + etag + `"`
+	w.Header().Set("Vary", "Accept-Encoding")
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	writeBody(w, r, body)
+}
+
+// etagMatches reports whether an If-None-Match header, a list of ETags or *,
+// matches etag. Weak ETags match their strong counterparts, as the weak
+// comparison If-None-Match calls for.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsGzip reports whether an Accept-Encoding header accepts gzip, by
+// name or as *, with a q-value above 0. A coding named explicitly takes
+// precedence over *.
+func acceptsGzip(header string) bool {
+	gzipQ, anyQ := -1.0, -1.0
+	for _, element := range strings.Split(header, ",") {
+		params := strings.Split(element, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+
+		q := 1.0
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(name, "q") {
+				var err error
+				if q, err = strconv.ParseFloat(value, 64); err != nil {
+					q = 0
+				}
+			}
+		}
+
+		switch coding {
+		case "gzip", "x-gzip":
+			gzipQ = q
+		case "*":
+			anyQ = q
+		}
+	}
+
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+	return anyQ > 0
+}
+
+// writeBody writes the response body, gzip-compressing it when the client
+// accepts it
+func writeBody(w http.ResponseWriter, r *http.Request, body []byte) {
+	w.Header().Set("Vary", "Accept-Encoding")
+	if !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+		w.Write(body)
+		return
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	gz := gzip.NewWriter(w)
+	defer gz.Close()
+	gz.Write(body)
+}
+
+// handleDebugMetrics handles the /debug/metrics endpoint, dumping the raw
+// internal metrics map with Go-syntax values to troubleshoot label keying
+// and value conversion
+func (a *App) handleDebugMetrics(w http.ResponseWriter, r *http.Request) {
+	if !a.requireAdmin(w, r) {
+		return
+	}
+
+	a.metricsMux.RLock()
+	defer a.metricsMux.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	response := make(map[string]map[string]string)
+	for _, metricSeries := range a.metrics {
+		for key, s := range metricSeries {
+			response[key] = map[string]string{
+				"metric": s.metric,
+				"labels": seriesKey(s.name, s.labels),
+				"type":   fmt.Sprintf("%T", s.value),
+				"value":  fmt.Sprintf("%#v", s.value),
+			}
 		}
 	}
 
 	json.NewEncoder(w).Encode(response)
 }
 
-// handleHealth handles the /health endpoint
-func (a *App) handleHealth(w http.ResponseWriter, r *http.Request) {
-	// Check database connection
-	err := a.db.Ping()
+// handleReload reloads the config from where it was loaded at startup, like
+// Prometheus's /-/reload
+func (a *App) handleReload(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) || !a.requireAdmin(w, r) {
+		return
+	}
+
+	if err := a.reloadConfig(); err != nil {
+		log.Printf("Error reloading config: %v", err)
+		http.Error(w, fmt.Sprintf("Error reloading config: %v", err), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprint(w, "Config reloaded\n")
+}
+
+// handleQuit shuts the app down gracefully, like Prometheus's /-/quit
+func (a *App) handleQuit(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) || !a.requireAdmin(w, r) {
+		return
+	}
+
+	fmt.Fprint(w, "Shutting down\n")
+
+	// Shutdown waits for in-flight requests, including this one
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := a.Shutdown(ctx); err != nil {
+			log.Printf("Error shutting down: %v", err)
+		}
+	}()
+}
+
+// reloadConfig loads the config again from where it was loaded at startup
+// and applies it
+func (a *App) reloadConfig() error {
+	config, err := LoadConfig(a.configPath, a.strictConfig)
 	if err != nil {
-		w.WriteHeader(http.StatusServiceUnavailable)
-		fmt.Fprintf(w, "Database connection error: %v", err)
+		return err
+	}
+	if err := config.Validate(); err != nil {
+		return fmt.Errorf("invalid config:\n%w", err)
+	}
+	return a.Reload(config)
+}
+
+// requirePost responds with 405 and returns false unless the request is a POST
+func requirePost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+// requireAdmin checks the request carries the admin bearer token, responding
+// with an error and returning false if it doesn't
+func (a *App) requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if a.config.AdminToken == "" {
+		http.Error(w, "Admin endpoints are disabled, set admin_token to enable them", http.StatusForbidden)
+		return false
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.config.AdminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// handleHealth handles the /health endpoint, a liveness check that succeeds
+// as long as the process serves requests. Unreachable databases don't fail
+// it, restarting the exporter wouldn't bring them back.
+func (a *App) handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": healthOK,
+	})
+}
+
+// handleReady handles the /ready endpoint, a readiness check reporting the
+// status of every database. The exporter is ready while any database is
+// reachable, once a metric has been collected.
+func (a *App) handleReady(w http.ResponseWriter, r *http.Request) {
+	if a.rejectIfShuttingDown(w) {
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprint(w, "OK")
+	a.dbMux.RLock()
+	dbs := map[string]*sql.DB{defaultDatabase: a.db}
+	for name, db := range a.namedDBs {
+		dbs[name] = db
+	}
+	a.dbMux.RUnlock()
+
+	// Check every database connection in parallel
+	var (
+		wg        sync.WaitGroup
+		resultMux sync.Mutex
+	)
+	results := make(map[string]databaseHealth, len(dbs))
+	for name, db := range dbs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			result := databaseHealth{Status: healthOK}
+			if err := a.ping(r.Context(), db); err != nil {
+				result = databaseHealth{Status: healthDown, Error: err.Error()}
+			}
+
+			resultMux.Lock()
+			results[name] = result
+			resultMux.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	down := 0
+	for _, result := range results {
+		if result.Status == healthDown {
+			down++
+		}
+	}
+
+	collected := a.collectedAny()
+
+	// Keep serving while any database is reachable
+	status, code := healthOK, http.StatusOK
+	switch {
+	case down == len(results):
+		status, code = healthDown, http.StatusServiceUnavailable
+	case !collected:
+		status, code = healthStarting, http.StatusServiceUnavailable
+	case down > 0:
+		status = healthDegraded
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":    status,
+		"databases": results,
+		"collected": collected,
+	})
+}
+
+// collectedAny reports whether any metric has been collected successfully.
+// Without metrics collected in the background there is nothing to wait for.
+func (a *App) collectedAny() bool {
+	a.metricsMux.RLock()
+	defer a.metricsMux.RUnlock()
+
+	background := false
+	for _, metric := range a.config.Metrics {
+		if metric.OnScrape {
+			continue
+		}
+		if !a.stats[metric.Name].collected.IsZero() {
+			return true
+		}
+		background = true
+	}
+	return !background
+}
+
+// databaseHealth is the result of checking a database connection
+type databaseHealth struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ping checks a database connection, giving each attempt the health check
+// timeout and retrying failed attempts
+func (a *App) ping(ctx context.Context, db pinger) error {
+	var err error
+	for attempt := 0; attempt <= a.config.HealthCheck.Retries; attempt++ {
+		pingCtx, cancel := context.WithTimeout(ctx, a.config.HealthCheck.Timeout)
+		err = db.PingContext(pingCtx)
+		cancel()
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+	return err
 }
 
 func main() {
 	configFile := flag.String("config", "", "Path to config file")
+	strictConfig := flag.Bool("strict-config", false, "Reject unknown fields in the config instead of ignoring them")
+	selfTest := flag.Bool("self-test", false, "Run every query once at startup and fail if a value column isn't numeric")
+	validate := flag.Bool("validate", false, "Run the self-test and exit")
+	configRefresh := flag.Duration("config-refresh", time.Minute, "How often to re-fetch a config loaded from a URL, reloading it when changed (0 disables)")
 	flag.Parse()
 
-	config, err := LoadConfig(*configFile)
+	// Match GOMAXPROCS to the container's CPU limit, which the collection
+	// concurrency is sized by
+	if _, err := maxprocs.Set(maxprocs.Logger(log.Printf)); err != nil {
+		log.Printf("Error setting GOMAXPROCS: %v", err)
+	}
+
+	config, err := LoadConfig(*configFile, *strictConfig)
 	if err != nil {
 		log.Fatalf("Error loading config: %v", err)
 	}
+	if err := config.Validate(); err != nil {
+		log.Fatalf("Invalid config:\n%v", err)
+	}
 
 	log.Printf("Starting application with %d metrics", len(config.Metrics))
 
-	ctx := context.Background()
+	// Shut down gracefully on SIGINT or SIGTERM. Once shutdown has begun the
+	// default handling is restored, so a second signal exits immediately.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	context.AfterFunc(ctx, stop)
+
 	app, err := NewApp(config)
 	if err != nil {
 		log.Fatalf("Error creating app: %v", err)
 	}
+	app.configPath, app.strictConfig = *configFile, *strictConfig
+	app.publishExpvars()
+
+	if err := app.WaitForDatabases(ctx); err != nil {
+		log.Fatalf("Error connecting to databases: %v", err)
+	}
+
+	if *selfTest || *validate {
+		if err := app.SelfTest(); err != nil {
+			log.Fatalf("Self-test failed:\n%v", err)
+		}
+		log.Printf("Self-test passed")
+
+		if *validate {
+			return
+		}
+	}
+
+	if isConfigURL(*configFile) && *configRefresh > 0 {
+		go app.watchConfigURL(ctx, *configFile, *configRefresh, *strictConfig)
+	}
+	go app.watchReloadSignal(ctx)
+	go app.watchDumpSignal(ctx)
 
-	log.Fatal(app.Start(ctx))
+	if err := app.Start(ctx); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Shut down")
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// metricMetadata describes an exposed metric, as returned by a metadata query
+type metricMetadata struct {
+	help       string
+	metricType string
+	unit       string
+}
+
+// collectMetadata refreshes the metric's metadata at its metadata interval
+func (a *App) collectMetadata(ctx context.Context, metric MetricConfig) {
+	ticker := time.NewTicker(metric.MetadataInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := a.runMetadataQuery(ctx, metric); err != nil {
+			// Keep serving the cached metadata
+			log.Printf("Error collecting metadata for metric %s: %v", metric.Name, err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// runMetadataQuery executes the metric's metadata query and caches the help,
+// type and unit of each metric it names
+func (a *App) runMetadataQuery(ctx context.Context, metric MetricConfig) error {
+	rows, err := a.dbFor(metric).QueryContext(ctx, metric.MetadataQuery)
+	if err != nil {
+		return fmt.Errorf("error executing query: %w", err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return fmt.Errorf("error getting columns: %w", err)
+	}
+
+	nameIdx := columnIndex(columns, "name")
+	if nameIdx == -1 {
+		return fmt.Errorf("metadata query must include a 'name' column")
+	}
+	helpIdx := columnIndex(columns, "help")
+	typeIdx := columnIndex(columns, "type")
+	unitIdx := columnIndex(columns, "unit")
+
+	values := make([]interface{}, len(columns))
+	valuePtrs := make([]interface{}, len(columns))
+	for i := range values {
+		valuePtrs[i] = &values[i]
+	}
+
+	// column returns a row's value of an optional column
+	column := func(idx int) string {
+		if idx == -1 || values[idx] == nil {
+			return ""
+		}
+		return labelString(values[idx])
+	}
+
+	metadata := make(map[string]metricMetadata)
+	for rows.Next() {
+		if err := rows.Scan(valuePtrs...); err != nil {
+			return fmt.Errorf("error scanning row: %w", err)
+		}
+
+		md := metricMetadata{
+			help:       column(helpIdx),
+			metricType: strings.ToLower(column(typeIdx)),
+			unit:       column(unitIdx),
+		}
+		name := column(nameIdx)
+		if md.metricType != "" && !rowMetricTypes[md.metricType] {
+			log.Printf("Ignoring unsupported metric type %q in metadata of %s", md.metricType, name)
+			md.metricType = ""
+		}
+		if md.unit != "" && !hasUnitSuffix(name, md.unit) {
+			log.Printf("Ignoring unit %q in metadata of %s, its name must end in _%s", md.unit, name, md.unit)
+			md.unit = ""
+		}
+		metadata[name] = md
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	a.metricsMux.Lock()
+	defer a.metricsMux.Unlock()
+	for name, md := range metadata {
+		a.metadata[name] = md
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetadataQuery(t *testing.T) {
+	app := newTestApp(t, `{
+		"database": {"driver": "mock", "mock": [
+			{"query": "SELECT name, value FROM app_metrics", "columns": ["name", "value"], "rows": [["jobs_done_total", 12], ["queue_depth", 4], ["cache_size_bytes", 2048], ["lag", 3]]},
+			{"query": "SELECT name, help, type, unit FROM app_metric_docs", "columns": ["name", "help", "type", "unit"], "rows": [
+				["jobs_done_total", "Jobs finished", "COUNTER", null],
+				["queue_depth", null, "histogram", null],
+				["cache_size_bytes", "Cache size", "gauge", "bytes"],
+				["lag", "Replication lag", null, "seconds"]
+			]},
+			{"query": "SELECT name FROM broken_docs", "error": "table broken_docs doesn't exist"}
+		]},
+		"metrics": [{"name": "app_metrics", "query": "SELECT name, value FROM app_metrics", "name_column": "name", "metadata_query": "SELECT name, help, type, unit FROM app_metric_docs"}]
+	}`)
+	metric := app.config.Metrics[0]
+	if err := app.runMetadataQuery(context.Background(), metric); err != nil {
+		t.Fatalf("runMetadataQuery() error = %v", err)
+	}
+
+	want := []string{
+		"# HELP jobs_done_total Jobs finished",
+		"# TYPE jobs_done_total counter",
+		// An unsupported type keeps the default, as does a NULL help
+		"# HELP queue_depth Value from custom SQL query",
+		"# TYPE queue_depth gauge",
+		"# HELP cache_size_bytes Cache size",
+		"# HELP lag Replication lag",
+	}
+	wantLines(t, scrape(t, app, "/metrics"), want...)
+
+	// Units are only exposed in OpenMetrics, and only matching the name
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text")
+	rec := httptest.NewRecorder()
+	app.routes().ServeHTTP(rec, req)
+	wantLines(t, rec.Body.String(), "# UNIT cache_size_bytes bytes")
+	if body := rec.Body.String(); strings.Contains(body, "# UNIT lag") {
+		t.Errorf("unit not matching the name was exposed:\n%s", body)
+	}
+
+	// A failing refresh keeps the cached metadata
+	metric.MetadataQuery = "SELECT name FROM broken_docs"
+	if err := app.runMetadataQuery(context.Background(), metric); err == nil {
+		t.Error("runMetadataQuery() of a broken query error = nil")
+	}
+	wantLines(t, scrape(t, app, "/metrics"), want...)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// mockDriverName is the driver name that selects the built-in mock driver
+const mockDriverName = "mock"
+
+// MockResult is a canned result set returned by the mock driver for a query
+type MockResult struct {
+	Query   string          `json:"query"`
+	Columns []string        `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+	// Error makes the query fail with this message instead of returning rows
+	Error string `json:"error"`
+}
+
+// mockAdapter is a QueryAdapter serving canned result sets from the config,
+// allowing the exporter to run without a database
+type mockAdapter struct {
+	results map[string]MockResult
+}
+
+// newMockAdapter creates a mock adapter for the config's result sets
+func newMockAdapter(cfg DatabaseConfig) (QueryAdapter, error) {
+	a := &mockAdapter{results: make(map[string]MockResult)}
+	for _, result := range cfg.Mock {
+		a.results[normalizeQuery(result.Query)] = result
+	}
+	return a, nil
+}
+
+// Query implements QueryAdapter by looking up the canned result set for query
+func (a *mockAdapter) Query(ctx context.Context, query string, args []interface{}) (*QueryResult, error) {
+	result, ok := a.results[normalizeQuery(query)]
+	if !ok {
+		return nil, fmt.Errorf("mock: no result configured for query %q", query)
+	}
+	if result.Error != "" {
+		return nil, errors.New(result.Error)
+	}
+	return &QueryResult{Columns: result.Columns, Rows: result.Rows}, nil
+}
+
+// Ping implements QueryAdapter
+func (a *mockAdapter) Ping(ctx context.Context) error {
+	return nil
+}
+
+// normalizeQuery collapses whitespace so queries match regardless of formatting
+func normalizeQuery(query string) string {
+	return strings.Join(strings.Fields(query), " ")
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ProbeConfig holds the configuration for /probe, which runs a metric's query
+// against a target database supplied at scrape time
+type ProbeConfig struct {
+	// Driver is the database driver of probed targets, the main database's
+	// driver when empty
+	Driver string `json:"driver"`
+	// Targets are the DSNs that may be probed, where * stands for any part
+	// of a host name or port. Probing is disabled when empty.
+	Targets []string `json:"targets"`
+	// Timeout bounds a probe, including connecting to the target
+	Timeout time.Duration `json:"timeout"`
+}
+
+// probeTargetAllowed reports whether target matches one of the allowed DSN
+// templates. A * can't match across the characters delimiting the parts of
+// a DSN, so a template can't be stretched to other credentials, databases or
+// connection options.
+func probeTargetAllowed(target string, templates []string) bool {
+	for _, template := range templates {
+		pattern := "^" + strings.ReplaceAll(regexp.QuoteMeta(template), `\*`, `[^/@()?&=]*`) + "$"
+		if regexp.MustCompile(pattern).MatchString(target) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleProbe runs the metric named by the metric parameter against the
+// database named by the target parameter, like blackbox_exporter's /probe
+func (a *App) handleProbe(w http.ResponseWriter, r *http.Request) {
+	if a.rejectIfShuttingDown(w) {
+		return
+	}
+	if len(a.config.Probe.Targets) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	target := r.URL.Query().Get("target")
+	if !probeTargetAllowed(target, a.config.Probe.Targets) {
+		http.Error(w, "Target is not allowed", http.StatusForbidden)
+		return
+	}
+
+	name := r.URL.Query().Get("metric")
+	var metric MetricConfig
+	var found bool
+	for _, m := range a.metricConfigs() {
+		if m.Name == name {
+			metric, found = m, true
+			break
+		}
+	}
+	if !found {
+		http.Error(w, fmt.Sprintf("Unknown metric %q", name), http.StatusBadRequest)
+		return
+	}
+	if len(metric.Params) > 0 {
+		http.Error(w, fmt.Sprintf("Metric %s takes scrape parameters and can't be probed", name), http.StatusBadRequest)
+		return
+	}
+
+	a.metricsMux.RLock()
+	dbConfig := a.config.Database
+	a.metricsMux.RUnlock()
+	if a.config.Probe.Driver != "" {
+		dbConfig.Driver = a.config.Probe.Driver
+	}
+	dbConfig.DSN = target
+	dbConfig.MaxOpen = 1
+	dbConfig.MaxIdle = 0
+
+	db, err := openDB(dbConfig)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error opening target: %v", err), http.StatusBadRequest)
+		return
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.config.Probe.Timeout)
+	defer cancel()
+
+	// A probe runs against another database than the metric's collections,
+	// so it doesn't touch the metric's statistics
+	series, err := a.query(ctx, db, metric, nil, metric.Query)
+	if err != nil {
+		log.Printf("Error probing metric %s: %v", metric.Name, err)
+		http.Error(w, fmt.Sprintf("Error probing target: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	a.metricsMux.RLock()
+	defer a.metricsMux.RUnlock()
+
+	openMetrics := negotiateFormat(w, r)
+	a.writeSeries(w, series, openMetrics)
+	if openMetrics {
+		fmt.Fprint(w, "# EOF\n")
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestProbeTargetAllowed(t *testing.T) {
+	templates := []string{
+		"exporter:secret@tcp(*:3306)/app",
+		"postgres://exporter@db-*.internal:5432/app?sslmode=require",
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		want   bool
+	}{
+		{name: "exact host", target: "exporter:secret@tcp(db1:3306)/app", want: true},
+		{name: "empty wildcard", target: "exporter:secret@tcp(:3306)/app", want: true},
+		{name: "host part", target: "postgres://exporter@db-7.internal:5432/app?sslmode=require", want: true},
+		{name: "other port", target: "exporter:secret@tcp(db1:3307)/app", want: false},
+		{name: "other database", target: "exporter:secret@tcp(db1:3306)/other", want: false},
+		{name: "other credentials", target: "root:pw@tcp(db1:3306)/app", want: false},
+		{name: "wildcard across parts", target: "exporter:secret@tcp(db1:3306)/x@tcp(db1:3306)/app", want: false},
+		{name: "wildcard across options", target: "postgres://exporter@db-1.internal:5432/app?sslmode=disable&x=db-1.internal:5432/app?sslmode=require", want: false},
+		{name: "added option", target: "postgres://exporter@db-1.internal:5432/app?sslmode=require&sslmode=disable", want: false},
+		{name: "dot is literal", target: "postgres://exporter@db-1Xinternal:5432/app?sslmode=require", want: false},
+		{name: "empty", target: "", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := probeTargetAllowed(tt.target, templates); got != tt.want {
+				t.Errorf("probeTargetAllowed(%q) = %v, want %v", tt.target, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PushConfig holds the configuration for pushing metrics to a Prometheus
+// Pushgateway, in addition to serving them for scraping
+type PushConfig struct {
+	// URL of the group to push to, e.g.
+	// http://pushgateway:9091/metrics/job/sql. Pushing is disabled when empty.
+	URL string `json:"url"`
+	// Interval between pushes, the global interval when zero
+	Interval time.Duration `json:"interval"`
+	// Delta only pushes the metric families that changed since the last push
+	Delta bool `json:"delta"`
+}
+
+// pusher pushes metrics to the push URL, remembering what it pushed last
+type pusher struct {
+	config PushConfig
+	client *http.Client
+	// last holds the text of each family as last pushed
+	last map[string]string
+}
+
+// pushMetrics pushes the metrics at the push interval
+func (a *App) pushMetrics(ctx context.Context) {
+	p := &pusher{
+		config: a.config.Push,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+
+	ticker := time.NewTicker(p.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := a.push(ctx, p); err != nil {
+				log.Printf("Error pushing metrics: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// push sends the current metrics to the push URL. A full push replaces the
+// whole group, while a delta push only sends the families that changed, each
+// of which replaces the family of the same name in the group. Families can
+// only be removed from the group by a full push.
+func (a *App) push(ctx context.Context, p *pusher) error {
+	a.metricsMux.RLock()
+	families := a.renderFamilies(a.currentSeries(outputPush), false)
+	a.metricsMux.RUnlock()
+
+	method, changed := http.MethodPut, families
+	if p.config.Delta && p.last != nil && !familiesRemoved(p.last, families) {
+		method = http.MethodPost
+		changed = make(map[string]string)
+		for name, text := range families {
+			if p.last[name] != text {
+				changed[name] = text
+			}
+		}
+		if len(changed) == 0 {
+			return nil
+		}
+	}
+
+	names := make([]string, 0, len(changed))
+	for name := range changed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var body bytes.Buffer
+	for _, name := range names {
+		body.WriteString(changed[name])
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, p.config.URL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("push returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	p.last = families
+	return nil
+}
+
+// familiesRemoved reports whether any family in last is missing from current
+func familiesRemoved(last, current map[string]string) bool {
+	for name := range last {
+		if _, ok := current[name]; !ok {
+			return true
+		}
+	}
+	return false
+}
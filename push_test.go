@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// pushRequest is a request received by a test Pushgateway
+type pushRequest struct {
+	method string
+	body   string
+}
+
+func TestDeltaPush(t *testing.T) {
+	var mu sync.Mutex
+	var requests []pushRequest
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, pushRequest{method: r.Method, body: string(body)})
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	app := newTestApp(t, `{
+		"database": {"driver": "mock", "mock": [{"query": "SELECT 1 AS value", "columns": ["value"], "rows": [[1]]}]},
+		"push": {"url": "`+server.URL+`", "delta": true},
+		"metrics": [
+			{"name": "a", "query": "SELECT 1 AS value"},
+			{"name": "b", "query": "SELECT 1 AS value"}
+		]
+	}`)
+	p := &pusher{config: app.config.Push, client: server.Client()}
+
+	// push pushes and returns the request it made, if any
+	push := func() *pushRequest {
+		t.Helper()
+		mu.Lock()
+		n := len(requests)
+		mu.Unlock()
+		if err := app.push(context.Background(), p); err != nil {
+			t.Fatalf("push() error = %v", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if len(requests) == n {
+			return nil
+		}
+		return &requests[len(requests)-1]
+	}
+
+	req := push()
+	if req == nil || req.method != http.MethodPut || !strings.Contains(req.body, "\na 1\n") || !strings.Contains(req.body, "\nb 1\n") {
+		t.Fatalf("first push = %+v, want a full PUT of a and b", req)
+	}
+	if req := push(); req != nil {
+		t.Errorf("push without changes = %+v, want none", req)
+	}
+
+	app.metricsMux.Lock()
+	for key, s := range app.metrics["b"] {
+		s.value = int64(2)
+		app.metrics["b"][key] = s
+	}
+	app.metricsMux.Unlock()
+	req = push()
+	if req == nil || req.method != http.MethodPost || !strings.Contains(req.body, "\nb 2\n") || strings.Contains(req.body, "\na 1\n") {
+		t.Errorf("push after b changed = %+v, want a POST of only b", req)
+	}
+
+	// Only a full push removes a family from the group
+	app.metricsMux.Lock()
+	app.deleteSeries(app.config.Metrics[0])
+	app.metricsMux.Unlock()
+	req = push()
+	if req == nil || req.method != http.MethodPut || strings.Contains(req.body, "\na 1\n") {
+		t.Errorf("push after a was removed = %+v, want a full PUT without a", req)
+	}
+
+	mu.Lock()
+	status = http.StatusBadGateway
+	mu.Unlock()
+	app.metricsMux.Lock()
+	for key, s := range app.metrics["b"] {
+		s.value = int64(3)
+		app.metrics["b"][key] = s
+	}
+	app.metricsMux.Unlock()
+	if err := app.push(context.Background(), p); err == nil || !strings.Contains(err.Error(), "502") {
+		t.Errorf("push() to a failing gateway error = %v, want its status", err)
+	}
+	// What failed to push still counts as changed on the next push
+	if !strings.Contains(p.last["b"], "b 2") {
+		t.Errorf("failed push replaced what was pushed last: %q", p.last["b"])
+	}
+}
+
+func TestOutputRouting(t *testing.T) {
+	var mu sync.Mutex
+	var pushed string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		pushed = string(body)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	app := newTestApp(t, `{
+		"database": {"driver": "mock", "mock": [{"query": "SELECT 1 AS value", "columns": ["value"], "rows": [[1]]}]},
+		"push": {"url": "`+server.URL+`"},
+		"metrics": [
+			{"name": "everywhere", "query": "SELECT 1 AS value"},
+			{"name": "scraped", "query": "SELECT 1 AS value", "output": "scrape"},
+			{"name": "nightly_batch_rows", "query": "SELECT 1 AS value", "output": "push"}
+		]
+	}`)
+	if err := app.push(context.Background(), &pusher{config: app.config.Push, client: server.Client()}); err != nil {
+		t.Fatalf("push() error = %v", err)
+	}
+
+	mu.Lock()
+	body := "\n" + pushed
+	mu.Unlock()
+	if !strings.Contains(body, "\neverywhere 1\n") || !strings.Contains(body, "\nnightly_batch_rows 1\n") || strings.Contains(body, "\nscraped ") {
+		t.Errorf("pushed %q, want everywhere and nightly_batch_rows only", body)
+	}
+
+	body = scrape(t, app, "/metrics")
+	wantLines(t, body, "everywhere 1", "scraped 1")
+	if strings.Contains(body, "\nnightly_batch_rows ") {
+		t.Errorf("/metrics serves a metric routed to push:\n%s", body)
+	}
+	if body := scrape(t, app, "/metrics.json"); strings.Contains(body, "nightly_batch_rows") || !strings.Contains(body, "scraped") {
+		t.Errorf("/metrics.json = %s, want the pushed metric left out", body)
+	}
+
+	for output, want := range map[string]string{
+		"push":  "metric m is output to push, but push.url isn't set",
+		"kafka": `metric m has unsupported output "kafka"`,
+	} {
+		_, err := parseConfig(strings.NewReader(`{
+			"database": {"driver": "mock"},
+			"metrics": [{"name": "m", "query": "SELECT 1 AS value", "output": "`+output+`"}]
+		}`), "test config", configFormatJSON, false)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("output %s: parseConfig() error = %v, want %q", output, err, want)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+)
+
+// watchReloadSignal reloads the config every time the process receives
+// SIGHUP, until ctx is done. A config that can't be loaded leaves the
+// current one running.
+func (a *App) watchReloadSignal(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case <-signals:
+			if err := a.reloadConfig(); err != nil {
+				log.Printf("Error reloading config, keeping the current one: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// metricConfigs returns the configured metrics, which may change on reload
+func (a *App) metricConfigs() []MetricConfig {
+	a.metricsMux.RLock()
+	defer a.metricsMux.RUnlock()
+	return a.config.Metrics
+}
+
+// startCollectors starts the collectors of metrics, at most
+// CollectorStartBatch at a time. Each further batch is started once the
+// previous one has finished its first collections, so starting a large config
+// doesn't spike goroutines and connections. Must be called with collectorMux
+// held.
+func (a *App) startCollectors(metrics []MetricConfig) {
+	batch := a.config.CollectorStartBatch
+	if batch <= 0 || len(metrics) <= batch {
+		for _, metric := range metrics {
+			a.startCollector(metric, nil)
+		}
+		return
+	}
+
+	// The collectors are registered right away so a reload or shutdown can
+	// stop the ones not launched yet
+	ctxs := make([]context.Context, len(metrics))
+	for i, metric := range metrics {
+		ctxs[i] = a.registerCollector(metric)
+	}
+
+	a.collectorWG.Add(1)
+	go func() {
+		defer a.collectorWG.Done()
+		for start := 0; start < len(metrics); start += batch {
+			end := min(start+batch, len(metrics))
+			log.Printf("Starting collectors %d to %d of %d", start+1, end, len(metrics))
+
+			var started sync.WaitGroup
+			for i := start; i < end; i++ {
+				if ctxs[i] == nil || ctxs[i].Err() != nil {
+					continue
+				}
+				started.Add(1)
+				a.launchCollector(ctxs[i], metrics[i], started.Done)
+			}
+			started.Wait()
+		}
+	}()
+}
+
+// startCollector starts the collection goroutines of a metric. started, if
+// not nil, is called once its first collection has finished. Must be called
+// with collectorMux held.
+func (a *App) startCollector(metric MetricConfig, started func()) {
+	if ctx := a.registerCollector(metric); ctx != nil {
+		a.launchCollector(ctx, metric, started)
+	} else if started != nil {
+		started()
+	}
+}
+
+// registerCollector registers the collectors of a metric, returning the
+// context that stops them, or nil if the metric has no collectors. Must be
+// called with collectorMux held.
+func (a *App) registerCollector(metric MetricConfig) context.Context {
+	if metric.OnScrape && metric.MetadataQuery == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(a.ctx)
+	a.collectors[metric.Name] = cancel
+	return ctx
+}
+
+// launchCollector starts the collection goroutines of a registered metric.
+// started, if not nil, is called once its first collection has finished.
+func (a *App) launchCollector(ctx context.Context, metric MetricConfig, started func()) {
+	if started == nil {
+		started = func() {}
+	}
+
+	if metric.OnScrape {
+		started()
+	} else {
+		a.collectorWG.Add(1)
+		go func() {
+			defer a.collectorWG.Done()
+			a.collectMetric(ctx, metric, started)
+		}()
+	}
+	if metric.MetadataQuery != "" {
+		a.collectorWG.Add(1)
+		go func() {
+			defer a.collectorWG.Done()
+			a.collectMetadata(ctx, metric)
+		}()
+	}
+}
+
+// stopCollector stops the collection goroutines of a metric. Must be called
+// with collectorMux held.
+func (a *App) stopCollector(name string) {
+	if cancel, ok := a.collectors[name]; ok {
+		cancel()
+		delete(a.collectors, name)
+	}
+}
+
+// Reload applies the metrics and database settings of config to the running
+// app. Collectors of added and changed metrics are started, those of removed
+// and changed metrics stopped, and unchanged metrics keep running with their
+// cached series. Connection pools are recreated when their settings changed.
+// Other settings only take effect on restart.
+func (a *App) Reload(config Config) error {
+	runOrders, err := dependencyOrders(config.Metrics)
+	if err != nil {
+		return fmt.Errorf("error in metric dependencies: %w", err)
+	}
+
+	a.collectorMux.Lock()
+	defer a.collectorMux.Unlock()
+
+	// Shutdown has stopped the collectors for good
+	if a.shuttingDown.Load() {
+		return fmt.Errorf("shutting down")
+	}
+
+	a.metricsMux.RLock()
+	old := a.config
+	a.metricsMux.RUnlock()
+
+	// Credentials issued by Vault replace the configured DSN
+	if a.vault != nil {
+		config.Database.DSN = old.Database.DSN
+	}
+
+	// Every changed pool is opened before any is swapped in, so a database
+	// that fails to open leaves the running pools and config untouched
+	var db *sql.DB
+	var metricDBs, namedDBs map[string]*sql.DB
+	if !reflect.DeepEqual(old.Database, config.Database) || !reflect.DeepEqual(poolSizes(old.Metrics), poolSizes(config.Metrics)) {
+		if db, metricDBs, err = openPools(config.Database, config.Metrics); err != nil {
+			return fmt.Errorf("error opening database: %w", err)
+		}
+	}
+	if !reflect.DeepEqual(old.Databases, config.Databases) {
+		if namedDBs, err = openNamedDBs(config.Databases); err != nil {
+			if db != nil {
+				closePools(db, metricDBs)
+			}
+			return err
+		}
+	}
+	a.swapDBs(db, metricDBs, namedDBs)
+
+	oldMetrics := make(map[string]MetricConfig, len(old.Metrics))
+	for _, metric := range old.Metrics {
+		oldMetrics[metric.Name] = metric
+	}
+
+	var added, changed, unchanged []MetricConfig
+	kept := make(map[string]bool, len(config.Metrics))
+	for _, metric := range config.Metrics {
+		kept[metric.Name] = true
+		prev, ok := oldMetrics[metric.Name]
+		switch {
+		case !ok:
+			added = append(added, metric)
+		case !reflect.DeepEqual(prev, metric):
+			changed = append(changed, metric)
+		default:
+			unchanged = append(unchanged, metric)
+		}
+	}
+
+	a.metricsMux.Lock()
+	a.config.Metrics = config.Metrics
+	a.config.Database = config.Database
+	a.config.Databases = config.Databases
+	a.runOrders = runOrders
+	for _, metric := range append(added, changed...) {
+		a.breakers[metric.Name] = newMetricBreaker(a.config.CircuitBreaker, metric)
+		a.stats[metric.Name] = &metricStats{}
+	}
+	// The breakers and stats of removed metrics are left for collections
+	// still in flight, only their series go
+	var removed int
+	for name, metric := range oldMetrics {
+		if !kept[name] {
+			a.deleteSeries(metric)
+			removed++
+		}
+	}
+	a.metricsMux.Unlock()
+
+	for name := range oldMetrics {
+		if !kept[name] {
+			a.stopCollector(name)
+		}
+	}
+	for _, metric := range changed {
+		a.stopCollector(metric.Name)
+	}
+	a.startCollectors(append(changed, added...))
+
+	log.Printf("Reloaded config: %d metrics added, %d removed, %d changed, %d unchanged",
+		len(added), removed, len(changed), len(unchanged))
+	return nil
+}
+
+// poolSizes returns the sizes of the dedicated pools of the metrics that have one
+func poolSizes(metrics []MetricConfig) map[string][2]int {
+	sizes := make(map[string][2]int)
+	for _, metric := range metrics {
+		if metric.Database == "" && (metric.MaxOpen > 0 || metric.MaxIdle > 0) {
+			sizes[metric.Name] = [2]int{metric.MaxOpen, metric.MaxIdle}
+		}
+	}
+	return sizes
+}
+
+// openNamedDBs opens the named databases, closing those already opened if
+// one fails
+func openNamedDBs(databases map[string]DatabaseConfig) (map[string]*sql.DB, error) {
+	namedDBs := make(map[string]*sql.DB, len(databases))
+	for name, dbConfig := range databases {
+		db, err := openDB(dbConfig)
+		if err != nil {
+			for _, opened := range namedDBs {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("error opening database %s: %w", name, err)
+		}
+		namedDBs[name] = db
+	}
+	return namedDBs, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReloadFailingDatabaseKeepsPools(t *testing.T) {
+	app := newTestApp(t, `{
+		"database": {"driver": "mock", "mock": [{"query": "SELECT 1 AS value", "columns": ["value"], "rows": [[1]]}]},
+		"databases": {"replica": {"driver": "mock"}},
+		"metrics": [{"name": "a", "query": "SELECT 1 AS value"}]
+	}`)
+
+	oldDB, oldNamed := app.sharedDB(), app.namedDBs["replica"]
+	oldConfig := app.config
+
+	config := app.config
+	config.Database.MaxOpen = 3
+	config.Databases = map[string]DatabaseConfig{
+		"replica": {Driver: "mock"},
+		"broken":  {Driver: "no-such-driver"},
+	}
+	config.Metrics = append([]MetricConfig{{Name: "b", Query: "SELECT 1 AS value"}}, config.Metrics...)
+
+	if err := app.Reload(config); err == nil {
+		t.Fatal("Reload() error = nil, want the broken database's error")
+	}
+
+	if app.sharedDB() != oldDB {
+		t.Error("Reload() replaced the main pool")
+	}
+	if app.namedDBs["replica"] != oldNamed || len(app.namedDBs) != 1 {
+		t.Errorf("Reload() replaced the named databases, got %v", app.namedDBs)
+	}
+	if err := oldDB.PingContext(context.Background()); err != nil {
+		t.Errorf("main pool after failed Reload() = %v, want it open", err)
+	}
+	if err := oldNamed.PingContext(context.Background()); err != nil {
+		t.Errorf("named database after failed Reload() = %v, want it open", err)
+	}
+	if !reflect.DeepEqual(app.config, oldConfig) {
+		t.Errorf("Reload() changed the config to %+v", app.config)
+	}
+}
+
+func TestReloadSwapsPools(t *testing.T) {
+	app := newTestApp(t, `{
+		"database": {"driver": "mock"},
+		"databases": {"replica": {"driver": "mock"}},
+		"metrics": []
+	}`)
+	oldDB, oldNamed := app.sharedDB(), app.namedDBs["replica"]
+
+	config := app.config
+	config.Database.MaxOpen = 3
+	config.Databases = map[string]DatabaseConfig{"replica": {Driver: "mock", MaxOpen: 2}}
+	if err := app.Reload(config); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+
+	if app.sharedDB() == oldDB || app.namedDBs["replica"] == oldNamed {
+		t.Error("Reload() kept the pools of changed databases")
+	}
+	if err := oldDB.PingContext(context.Background()); err == nil {
+		t.Error("Reload() left the replaced main pool open")
+	}
+	if err := oldNamed.PingContext(context.Background()); err == nil {
+		t.Error("Reload() left the replaced named database open")
+	}
+}
+
+func TestReloadRemovingMetricKeepsPrefixedMetrics(t *testing.T) {
+	app := newTestApp(t, `{
+		"database": {"driver": "mock", "mock": [
+			{"query": "SELECT 3 AS value", "columns": ["value"], "rows": [[3]]},
+			{"query": "SELECT kind, COUNT(*) AS value FROM bars GROUP BY kind", "columns": ["kind", "value"], "rows": [["x", 1], ["y", 2]]},
+			{"query": "SELECT 7 AS value", "columns": ["value"], "rows": [[7]]}
+		]},
+		"metrics": [
+			{"name": "foo", "query": "SELECT 3 AS value"},
+			{"name": "foo_bar", "query": "SELECT kind, COUNT(*) AS value FROM bars GROUP BY kind"},
+			{"name": "_internal", "query": "SELECT 7 AS value"}
+		]
+	}`)
+
+	config := app.config
+	config.Metrics = config.Metrics[1:]
+	if err := app.Reload(config); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+
+	body := scrape(t, app, "/metrics")
+	for _, want := range []string{
+		"foo_bar{kind=\"x\"} 1\n",
+		"foo_bar{kind=\"y\"} 2\n",
+		"# TYPE _internal gauge\n",
+		"\n_internal 7\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("/metrics doesn't contain %q:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "\nfoo 3\n") {
+		t.Errorf("series of the removed foo are still exposed:\n%s", body)
+	}
+}
+
+func TestReloadStartsCollectorsInBatches(t *testing.T) {
+	var mu sync.Mutex
+	var inFlight, maxInFlight, queries int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			return
+		}
+		io.Copy(io.Discard, r.Body)
+
+		mu.Lock()
+		inFlight++
+		maxInFlight = max(maxInFlight, inFlight)
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		queries++
+		mu.Unlock()
+
+		fmt.Fprint(w, `{"columns": ["value"], "rows": [[1]]}`)
+	}))
+	defer server.Close()
+
+	app := newTestApp(t, fmt.Sprintf(`{
+		"database": {"driver": "http", "dsn": %q},
+		"collector_start_batch": 3,
+		"concurrency_factor": 100,
+		"metrics": []
+	}`, server.URL))
+	logs := captureLog(t)
+
+	// Reloads start collectors under the context Start would set
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	app.ctx = ctx
+	defer app.Shutdown(context.Background())
+
+	var metrics []string
+	for i := range 7 {
+		metrics = append(metrics, fmt.Sprintf(`{"name": "m%d", "query": "SELECT %d AS value", "interval": "1h"}`, i, i))
+	}
+	large, err := parseConfig(strings.NewReader(`{"database": {"driver": "mock"}, "metrics": [`+strings.Join(metrics, ", ")+`]}`), "test config", configFormatJSON, false)
+	if err != nil {
+		t.Fatalf("parseConfig() error = %v", err)
+	}
+	config := app.config
+	config.Metrics = large.Metrics
+	if err := app.Reload(config); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		done := queries
+		mu.Unlock()
+		if done == 7 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of 7 collectors ran their first collection", done)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	mu.Lock()
+	if maxInFlight > 3 {
+		t.Errorf("%d collections ran at once, want at most the batch of 3", maxInFlight)
+	}
+	mu.Unlock()
+
+	out := logs.String()
+	last := -1
+	for _, want := range []string{
+		"Starting collectors 1 to 3 of 7",
+		"Starting collectors 4 to 6 of 7",
+		"Starting collectors 7 to 7 of 7",
+	} {
+		i := strings.Index(out, want)
+		if i < 0 || i < last {
+			t.Errorf("logs don't contain %q after the previous batch:\n%s", want, out)
+		}
+		last = i
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// rowCondition compares a column of a row to a value
+type rowCondition struct {
+	column string
+	op     string
+	value  string
+}
+
+// rowFilter is a parsed RowFilter: conditions a row must all meet to be kept
+type rowFilter []rowCondition
+
+// rowConditionRegexp matches a condition at the start of a row filter,
+// followed by "and" and the next condition or by the end of the filter.
+// Values are numbers, bare words or single-quoted strings.
+var rowConditionRegexp = regexp.MustCompile(`^\s*([a-zA-Z_][a-zA-Z0-9_]*)\s*(==|!=|<=|>=|<|>)\s*(?:'([^']*)'|([^\s'=<>!]+))\s*(?:(?i:and)\s+|$)`)
+
+// parseRowFilter parses a row filter such as
+// "status != 'archived' and count >= 10". An empty filter keeps every row.
+func parseRowFilter(expr string) (rowFilter, error) {
+	var filter rowFilter
+	rest := expr
+	for strings.TrimSpace(rest) != "" {
+		m := rowConditionRegexp.FindStringSubmatch(rest)
+		if m == nil {
+			return nil, fmt.Errorf("invalid condition at %q", strings.TrimSpace(rest))
+		}
+		value := m[3]
+		if m[4] != "" {
+			value = m[4]
+		}
+		filter = append(filter, rowCondition{column: m[1], op: m[2], value: value})
+		rest = rest[len(m[0]):]
+	}
+	return filter, nil
+}
+
+// match reports whether the row, given as each column's value as a string,
+// meets every condition. Values are compared as numbers when both sides are
+// numeric and as strings otherwise, only == and != apply to strings.
+func (f rowFilter) match(row map[string]string) (bool, error) {
+	for _, cond := range f {
+		actual, ok := row[cond.column]
+		if !ok {
+			return false, fmt.Errorf("unknown column %s", cond.column)
+		}
+
+		a, errA := strconv.ParseFloat(actual, 64)
+		b, errB := strconv.ParseFloat(cond.value, 64)
+		numeric := errA == nil && errB == nil
+
+		var met bool
+		switch cond.op {
+		case "==":
+			met = actual == cond.value || (numeric && a == b)
+		case "!=":
+			met = actual != cond.value && !(numeric && a == b)
+		default:
+			if !numeric {
+				return false, fmt.Errorf("can't compare %q %s %q, both must be numbers", actual, cond.op, cond.value)
+			}
+			switch cond.op {
+			case "<":
+				met = a < b
+			case "<=":
+				met = a <= b
+			case ">":
+				met = a > b
+			case ">=":
+				met = a >= b
+			}
+		}
+		if !met {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRowFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		expr    string
+		want    rowFilter
+		wantErr bool
+	}{
+		{
+			name: "empty",
+			expr: "  ",
+		},
+		{
+			name: "number",
+			expr: "count >= 10",
+			want: rowFilter{{column: "count", op: ">=", value: "10"}},
+		},
+		{
+			name: "quoted string",
+			expr: "status != 'archived'",
+			want: rowFilter{{column: "status", op: "!=", value: "archived"}},
+		},
+		{
+			name: "quoted string with spaces",
+			expr: "region=='us east'",
+			want: rowFilter{{column: "region", op: "==", value: "us east"}},
+		},
+		{
+			name: "bare word",
+			expr: "status == active",
+			want: rowFilter{{column: "status", op: "==", value: "active"}},
+		},
+		{
+			name: "conjunction",
+			expr: "status != 'archived' AND value > 1 and value < 5.5",
+			want: rowFilter{
+				{column: "status", op: "!=", value: "archived"},
+				{column: "value", op: ">", value: "1"},
+				{column: "value", op: "<", value: "5.5"},
+			},
+		},
+		{
+			name:    "unknown operator",
+			expr:    "count = 10",
+			wantErr: true,
+		},
+		{
+			name:    "or",
+			expr:    "count > 1 or count < 0",
+			wantErr: true,
+		},
+		{
+			name:    "dangling and",
+			expr:    "count > 1 and",
+			wantErr: true,
+		},
+		{
+			name:    "unterminated string",
+			expr:    "status == 'archived",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRowFilter(tt.expr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseRowFilter() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseRowFilter() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRowFilterMatch(t *testing.T) {
+	row := map[string]string{"status": "active", "value": "7", "code": "007"}
+
+	tests := []struct {
+		name    string
+		expr    string
+		want    bool
+		wantErr bool
+	}{
+		{name: "string equal", expr: "status == 'active'", want: true},
+		{name: "string not equal", expr: "status != 'active'", want: false},
+		{name: "numeric equal", expr: "code == 7", want: true},
+		{name: "numeric not equal", expr: "code != 7.0", want: false},
+		{name: "less", expr: "value < 10", want: true},
+		{name: "greater or equal", expr: "value >= 10", want: false},
+		{name: "all conditions", expr: "status == active and value > 5", want: true},
+		{name: "one condition fails", expr: "status == active and value > 8", want: false},
+		{name: "unknown column", expr: "missing == 1", wantErr: true},
+		{name: "non-numeric comparison", expr: "status > 1", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := parseRowFilter(tt.expr)
+			if err != nil {
+				t.Fatalf("parseRowFilter() error = %v", err)
+			}
+			got, err := filter.match(row)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("match() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
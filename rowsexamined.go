@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// handlerReadsQuery returns MySQL's Handler_read_* counters of the session,
+// which count the rows its statements read from storage
+const handlerReadsQuery = "SHOW SESSION STATUS LIKE 'Handler_read%'"
+
+// rowsExaminedDrivers are the drivers whose sessions have handler counters
+var rowsExaminedDrivers = map[string]bool{
+	"mysql":        true,
+	mockDriverName: true,
+}
+
+// handlerReads returns the sum of the Handler_read_* counters of the
+// session conn is attached to
+func handlerReads(ctx context.Context, conn *sql.Conn) (int64, error) {
+	rows, err := conn.QueryContext(ctx, handlerReadsQuery)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var total int64
+	for rows.Next() {
+		var name string
+		var value interface{}
+		if err := rows.Scan(&name, &value); err != nil {
+			return 0, err
+		}
+		n, ok := toFloat64(value)
+		if !ok {
+			return 0, fmt.Errorf("invalid value %q of %s", labelString(value), name)
+		}
+		total += int64(n)
+	}
+	return total, rows.Err()
+}
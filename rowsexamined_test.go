@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// handlerAdapter is a QueryAdapter whose session handler counters grow by
+// the rows each query reads
+type handlerAdapter struct {
+	mu    sync.Mutex
+	reads int64
+}
+
+// Query implements QueryAdapter
+func (a *handlerAdapter) Query(ctx context.Context, query string, args []interface{}) (*QueryResult, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if query == handlerReadsQuery {
+		// Split across counters, which are summed
+		return &QueryResult{
+			Columns: []string{"Variable_name", "Value"},
+			Rows:    [][]interface{}{{"Handler_read_key", float64(a.reads / 2)}, {"Handler_read_next", float64(a.reads - a.reads/2)}},
+		}, nil
+	}
+	a.reads += 1500
+	return &QueryResult{Columns: []string{"value"}, Rows: [][]interface{}{{float64(3)}}}, nil
+}
+
+// Ping implements QueryAdapter
+func (a *handlerAdapter) Ping(ctx context.Context) error {
+	return nil
+}
+
+func TestRowsExamined(t *testing.T) {
+	adapter := &handlerAdapter{reads: 1001}
+	queryAdapters["handlers"] = func(DatabaseConfig) (QueryAdapter, error) { return adapter, nil }
+	rowsExaminedDrivers["handlers"] = true
+	t.Cleanup(func() {
+		delete(queryAdapters, "handlers")
+		delete(rowsExaminedDrivers, "handlers")
+	})
+
+	app := newTestApp(t, `{
+		"database": {"driver": "handlers"},
+		"metrics": [
+			{"name": "pending_orders", "query": "SELECT COUNT(*) AS value FROM orders", "track_rows_examined": true},
+			{"name": "untracked", "query": "SELECT COUNT(*) AS value FROM orders"}
+		]
+	}`)
+
+	body := scrape(t, app, "/metrics")
+	wantLines(t, body, `sqlmetrics_query_rows_examined{metric="pending_orders"} 1500`)
+	if strings.Contains(body, `sqlmetrics_query_rows_examined{metric="untracked"}`) {
+		t.Errorf("/metrics has rows examined of an untracked metric:\n%s", body)
+	}
+
+	// Only the last query counts
+	if err := app.runQuery(context.Background(), app.config.Metrics[0]); err != nil {
+		t.Fatal(err)
+	}
+	wantLines(t, scrape(t, app, "/metrics"), `sqlmetrics_query_rows_examined{metric="pending_orders"} 1500`)
+
+	_, err := parseConfig(strings.NewReader(`{
+		"database": {"driver": "postgres"},
+		"metrics": [{"name": "m", "query": "SELECT 1 AS value", "track_rows_examined": true}]
+	}`), "test config", configFormatJSON, false)
+	want := `metric m tracks rows examined, which isn't supported by driver "postgres"`
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("parseConfig() error = %v, want %q", err, want)
+	}
+}
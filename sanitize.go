@@ -0,0 +1,48 @@
+package main
+
+import (
+	"log"
+	"regexp"
+	"sync"
+)
+
+// invalidLabelChars matches the characters not allowed in label names
+var invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// invalidMetricChars matches the characters not allowed in metric names
+var invalidMetricChars = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+
+// sanitizeLabelName turns name into a valid label name, replacing invalid
+// characters with underscores and prefixing an underscore if it starts with a
+// digit, e.g. "2xx count" becomes "_2xx_count"
+func sanitizeLabelName(name string) string {
+	return sanitizeName(name, invalidLabelChars)
+}
+
+// sanitizeMetricName turns name into a valid metric name like
+// sanitizeLabelName, but keeps colons
+func sanitizeMetricName(name string) string {
+	return sanitizeName(name, invalidMetricChars)
+}
+
+// sanitizeName replaces the characters of name matching invalid with
+// underscores, prefixing an underscore if it starts with a digit
+func sanitizeName(name string, invalid *regexp.Regexp) string {
+	name = invalid.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+// sanitizeWarnings holds the names a sanitization was logged for, so a query
+// returning the same invalid name on every collection only logs it once
+var sanitizeWarnings sync.Map
+
+// warnSanitized logs that a metric's label or metric name, as given by kind,
+// is exposed under its sanitized form
+func warnSanitized(metric, kind, name, sanitized string) {
+	if _, logged := sanitizeWarnings.LoadOrStore(metric+"\x00"+kind+"\x00"+name, true); !logged {
+		log.Printf("Warning: %s name %q of metric %s is invalid, exposing it as %q", kind, name, metric, sanitized)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeNames(t *testing.T) {
+	tests := []struct {
+		name       string
+		wantLabel  string
+		wantMetric string
+	}{
+		{name: "status", wantLabel: "status", wantMetric: "status"},
+		{name: "total count", wantLabel: "total_count", wantMetric: "total_count"},
+		{name: "2xx", wantLabel: "_2xx", wantMetric: "_2xx"},
+		{name: "http.requests-total", wantLabel: "http_requests_total", wantMetric: "http_requests_total"},
+		{name: "job:rate5m", wantLabel: "job_rate5m", wantMetric: "job:rate5m"},
+		{name: "région", wantLabel: "r_gion", wantMetric: "r_gion"},
+		{name: "", wantLabel: "_", wantMetric: "_"},
+	}
+	for _, tt := range tests {
+		if got := sanitizeLabelName(tt.name); got != tt.wantLabel {
+			t.Errorf("sanitizeLabelName(%q) = %q, want %q", tt.name, got, tt.wantLabel)
+		}
+		if got := sanitizeMetricName(tt.name); got != tt.wantMetric {
+			t.Errorf("sanitizeMetricName(%q) = %q, want %q", tt.name, got, tt.wantMetric)
+		}
+	}
+}
+
+func TestSanitizedExposition(t *testing.T) {
+	// Forget the warnings of earlier runs
+	sanitizeWarnings.Clear()
+	logs := captureLog(t)
+	app := newTestApp(t, `{
+		"database": {"driver": "mock", "mock": [
+			{"query": "SELECT name, 2xx, total count, value FROM requests", "columns": ["name", "2xx", "total count", "value"], "rows": [["http.requests", "yes", "many", 7]]}
+		]},
+		"metrics": [{"name": "requests", "query": "SELECT name, 2xx, total count, value FROM requests", "name_column": "name"}]
+	}`)
+	if err := app.runQuery(context.Background(), app.config.Metrics[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	wantLines(t, scrape(t, app, "/metrics"),
+		"# TYPE http_requests gauge",
+		`http_requests{_2xx="yes",total_count="many"} 7`,
+	)
+
+	// Each changed name is only warned about once
+	for _, want := range []string{`label name "2xx" of metric requests is invalid, exposing it as "_2xx"`, `metric name "http.requests" of metric requests is invalid, exposing it as "http_requests"`} {
+		if n := strings.Count(logs.String(), want); n != 1 {
+			t.Errorf("warning %q logged %d times, want once:\n%s", want, n, logs)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// SelfTest runs every metric's query once and checks each of its value
+// columns can be converted to a number for at least one row, so mistakes like
+// a value column returning text fail fast instead of showing up as skipped
+// metrics. The returned error lists every failing metric.
+func (a *App) SelfTest() error {
+	var errs []error
+	for _, metric := range a.config.Metrics {
+		if len(metric.Params) > 0 {
+			log.Printf("Warning: skipping self-test of metric %s, its query takes scrape parameters", metric.Name)
+			continue
+		}
+		if err := a.checkMetric(metric); err != nil {
+			errs = append(errs, fmt.Errorf("metric %s: %w", metric.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkMetric runs a single metric's query and verifies its value columns
+func (a *App) checkMetric(metric MetricConfig) error {
+	// A hanging query would stall startup, so it is bounded like a collection
+	ctx, cancel := context.WithTimeout(context.Background(), a.queryTimeout(metric))
+	defer cancel()
+
+	rows, err := a.dbFor(metric).QueryContext(ctx, metric.Query)
+	if err != nil {
+		return fmt.Errorf("error executing query: %w", err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return fmt.Errorf("error getting columns: %w", err)
+	}
+
+	// Presence-only metrics have no value column to verify
+	if metric.PresenceOnly {
+		return nil
+	}
+
+	var valueColumns []string
+	for _, col := range metric.ValueColumns {
+		valueColumns = append(valueColumns, col.Column)
+	}
+	switch {
+	case metric.Scalar && len(columns) == 1:
+		valueColumns = columns
+	case metric.Scalar:
+		return fmt.Errorf("scalar query must return a single column, got %d", len(columns))
+	case len(valueColumns) == 0:
+		valueColumns = []string{metric.ValueColumn}
+	}
+	valueIdxs := make([]int, len(valueColumns))
+	for i, col := range valueColumns {
+		if valueIdxs[i] = columnIndex(columns, col); valueIdxs[i] == -1 {
+			return fmt.Errorf("query must include a '%s' column", col)
+		}
+	}
+
+	values := make([]interface{}, len(columns))
+	valuePtrs := make([]interface{}, len(columns))
+	for i := range values {
+		valuePtrs[i] = &values[i]
+	}
+
+	// A column is verified once one of its values is numeric
+	count := 0
+	first := make([]interface{}, len(valueIdxs))
+	numeric := make([]bool, len(valueIdxs))
+	for rows.Next() {
+		if err := rows.Scan(valuePtrs...); err != nil {
+			return fmt.Errorf("error scanning row: %w", err)
+		}
+		count++
+
+		for i, valueIdx := range valueIdxs {
+			if count == 1 {
+				first[i] = values[valueIdx]
+			}
+			value := values[valueIdx]
+			if metric.DecimalSeparator != "" {
+				value = normalizeDecimal(value, metric.DecimalSeparator)
+			}
+			_, ok := toFloat64(value)
+			if metric.check {
+				_, ok = checkValue(value)
+			}
+			if ok || metric.StringValueAsLabel {
+				numeric[i] = true
+			}
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	if count == 0 {
+		// An empty result is legitimate for many labeled queries
+		log.Printf("Warning: self-test of metric %s returned no rows, value column not verified", metric.Name)
+		return nil
+	}
+
+	var errs []error
+	for i, col := range valueColumns {
+		if !numeric[i] {
+			errs = append(errs, fmt.Errorf("%s column is not numeric in any of %d rows (first value %T: %v)", col, count, first[i], labelString(first[i])))
+		}
+	}
+	return errors.Join(errs...)
+}
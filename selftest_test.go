@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	app := newTestApp(t, `{
+		"database": {"driver": "mock", "mock": [
+			{"query": "SELECT 1 AS value", "columns": ["value"], "rows": [[1]]},
+			{"query": "SELECT host, version AS value FROM servers", "columns": ["host", "value"], "rows": [["db1", "8.0.36"]]},
+			{"query": "SELECT region, total, tax FROM orders", "columns": ["region", "total", "tax"], "rows": [["eu", 5, "n/a"], ["us", 7, "none"]]},
+			{"query": "SELECT total AS amount FROM orders", "columns": ["amount"], "rows": [[3]]},
+			{"query": "SELECT id FROM locks", "columns": ["id"], "rows": [["a"]]},
+			{"query": "SELECT value FROM nothing", "columns": ["value"], "rows": []},
+			{"query": "SELECT value FROM broken", "error": "table broken doesn't exist"}
+		]},
+		"metrics": [
+			{"name": "ok", "query": "SELECT 1 AS value"},
+			{"name": "version", "query": "SELECT host, version AS value FROM servers"},
+			{"name": "version_label", "query": "SELECT host, version AS value FROM servers", "string_value_as_label": true},
+			{"name": "orders", "query": "SELECT region, total, tax FROM orders", "value_columns": ["total", "tax"]},
+			{"name": "missing", "query": "SELECT total AS amount FROM orders"},
+			{"name": "locks", "query": "SELECT id FROM locks", "presence_only": true},
+			{"name": "empty", "query": "SELECT value FROM nothing"},
+			{"name": "broken", "query": "SELECT value FROM broken"}
+		]
+	}`)
+
+	err := app.SelfTest()
+	if err == nil {
+		t.Fatal("SelfTest() error = nil, want the failing metrics")
+	}
+	for _, want := range []string{
+		"metric version: value column is not numeric in any of 1 rows (first value []uint8: 8.0.36)",
+		"metric orders: tax column is not numeric in any of 2 rows",
+		"metric missing: query must include a 'value' column",
+		"metric broken: error executing query: table broken doesn't exist",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("SelfTest() error = %v, want it to contain %q", err, want)
+		}
+	}
+	for _, passing := range []string{"metric ok:", "metric version_label:", "orders: total", "metric locks:", "metric empty:"} {
+		if strings.Contains(err.Error(), passing) {
+			t.Errorf("SelfTest() error = %v, want %q to pass", err, passing)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// pinger is a database whose connection can be checked, e.g. a *sql.DB
+type pinger interface {
+	PingContext(ctx context.Context) error
+}
+
+// maxStartupRetryInterval caps the doubling wait between startup pings
+const maxStartupRetryInterval = time.Minute
+
+// WaitForDatabases pings the shared and the named databases until each one
+// answers, so a database starting alongside the exporter delays collection
+// instead of failing it. Each database gets StartupRetries further pings, the
+// wait between them doubling from StartupRetryInterval.
+func (a *App) WaitForDatabases(ctx context.Context) error {
+	if a.config.StartupRetries <= 0 {
+		return nil
+	}
+
+	if err := a.waitForDB(ctx, "database", a.sharedDB()); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(a.namedDBs))
+	for name := range a.namedDBs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := a.waitForDB(ctx, "database "+name, a.namedDBs[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitForDB pings db with the startup retries, logging failed attempts
+func (a *App) waitForDB(ctx context.Context, name string, db pinger) error {
+	interval := a.config.StartupRetryInterval
+	for attempt := 0; ; attempt++ {
+		pingCtx, cancel := context.WithTimeout(ctx, a.config.HealthCheck.Timeout)
+		err := db.PingContext(pingCtx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if attempt >= a.config.StartupRetries {
+			return fmt.Errorf("%s unreachable after %d attempts: %w", name, attempt+1, err)
+		}
+
+		log.Printf("Waiting for %s, retrying in %s: %v", name, interval, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+		interval = min(interval*2, maxStartupRetryInterval)
+	}
+}
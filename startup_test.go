@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blockingPinger is a database whose pings hang until they are cancelled
+type blockingPinger struct{}
+
+func (blockingPinger) PingContext(ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestWaitForDBTimesOut(t *testing.T) {
+	app := newTestApp(t, `{
+		"database": {"driver": "mock"},
+		"health_check": {"timeout": "50ms"},
+		"startup_retries": 2,
+		"startup_retry_interval": "10ms",
+		"metrics": []
+	}`)
+
+	start := time.Now()
+	err := app.waitForDB(context.Background(), "database", blockingPinger{})
+	elapsed := time.Since(start)
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("waitForDB() error = %v, want the ping deadline", err)
+	}
+	// Three pings of 50ms and waits of 10ms and 20ms in between
+	if elapsed < 150*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("waitForDB() took %s, want about 180ms", elapsed)
+	}
+}
+
+func TestPingTimesOut(t *testing.T) {
+	app := newTestApp(t, `{
+		"database": {"driver": "mock"},
+		"health_check": {"timeout": "50ms", "retries": 1},
+		"metrics": []
+	}`)
+
+	start := time.Now()
+	err := app.ping(context.Background(), blockingPinger{})
+	elapsed := time.Since(start)
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("ping() error = %v, want the ping deadline", err)
+	}
+	if elapsed < 100*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("ping() took %s, want about 100ms for two attempts", elapsed)
+	}
+}
+
+// flakyPinger is a database whose first pings fail
+type flakyPinger struct {
+	failures int
+	pings    []time.Time
+}
+
+func (p *flakyPinger) PingContext(ctx context.Context) error {
+	p.pings = append(p.pings, time.Now())
+	if len(p.pings) <= p.failures {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func TestWaitForDBRetries(t *testing.T) {
+	logs := captureLog(t)
+	app := newTestApp(t, `{
+		"database": {"driver": "mock"},
+		"startup_retries": 3,
+		"startup_retry_interval": "20ms",
+		"metrics": []
+	}`)
+
+	// The wait between pings doubles until the database answers
+	db := &flakyPinger{failures: 2}
+	if err := app.waitForDB(context.Background(), "database", db); err != nil {
+		t.Fatalf("waitForDB() error = %v, want the third ping to succeed", err)
+	}
+	if len(db.pings) != 3 {
+		t.Fatalf("waitForDB() pinged %d times, want 3", len(db.pings))
+	}
+	if wait := db.pings[1].Sub(db.pings[0]); wait < 20*time.Millisecond {
+		t.Errorf("first wait = %s, want at least 20ms", wait)
+	}
+	if wait := db.pings[2].Sub(db.pings[1]); wait < 40*time.Millisecond {
+		t.Errorf("second wait = %s, want at least 40ms", wait)
+	}
+	for _, want := range []string{"Waiting for database, retrying in 20ms: connection refused", "Waiting for database, retrying in 40ms: connection refused"} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("log doesn't contain %q:\n%s", want, logs)
+		}
+	}
+
+	// The exporter gives up once the retries are used up
+	db = &flakyPinger{failures: 10}
+	err := app.waitForDB(context.Background(), "database replica", db)
+	if err == nil || err.Error() != "database replica unreachable after 4 attempts: connection refused" {
+		t.Errorf("waitForDB() error = %v, want the retries used up", err)
+	}
+
+	// Shutting down stops waiting
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if err := app.waitForDB(ctx, "database", &flakyPinger{failures: 10}); !errors.Is(err, context.Canceled) {
+		t.Errorf("waitForDB() error = %v, want it cancelled", err)
+	}
+}
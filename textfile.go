@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+)
+
+// writeTextfile writes the current metrics in the exposition format to the
+// textfile path, for node_exporter's textfile collector. The file is written
+// under a temporary name and renamed into place, so the collector never reads
+// a partially written file.
+func (a *App) writeTextfile() error {
+	// Serialize writes so an older rendering can't replace a newer one
+	a.textfileMux.Lock()
+	defer a.textfileMux.Unlock()
+
+	var buf bytes.Buffer
+	a.metricsMux.RLock()
+	a.writeSeries(&buf, a.currentSeries(outputTextfile), false)
+	a.metricsMux.RUnlock()
+
+	// The collector only reads *.prom files, so it skips the temporary file
+	path := a.config.TextfilePath
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	// CreateTemp makes the file readable by its owner only
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
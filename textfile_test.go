@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteTextfile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sql_metrics.prom")
+	if err := os.WriteFile(path, []byte("stale 1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	app := newTestApp(t, fmt.Sprintf(`{
+		"database": {"driver": "mock", "mock": [{"query": "SELECT 1 AS value", "columns": ["value"], "rows": [[1]]}]},
+		"textfile_path": %q,
+		"metrics": [
+			{"name": "up", "query": "SELECT 1 AS value"},
+			{"name": "scraped", "query": "SELECT 1 AS value", "output": "scrape"},
+			{"name": "filed", "query": "SELECT 1 AS value", "output": "textfile"}
+		]
+	}`, path))
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := "\n" + string(data)
+	for _, want := range []string{"\nup 1\n", "\nfiled 1\n"} {
+		if !strings.Contains(content, want) {
+			t.Errorf("textfile doesn't contain %q:\n%s", strings.TrimSpace(want), data)
+		}
+	}
+	for _, unwanted := range []string{"\nstale ", "\nscraped ", "\nsqlmetrics_"} {
+		if strings.Contains(content, unwanted) {
+			t.Errorf("textfile contains %q:\n%s", strings.TrimSpace(unwanted), data)
+		}
+	}
+
+	// The file replaced the old one whole, readable by node_exporter
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o644 {
+		t.Errorf("textfile mode = %v, want 0644", info.Mode().Perm())
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("textfile directory has %d entries, want the temporary files removed", len(entries))
+	}
+
+	if body := scrape(t, app, "/metrics"); strings.Contains(body, "\nfiled ") {
+		t.Errorf("/metrics serves a metric routed to the textfile:\n%s", body)
+	}
+
+	// Routing to the textfile needs a path
+	_, err = parseConfig(strings.NewReader(`{
+		"database": {"driver": "mock"},
+		"metrics": [{"name": "filed", "query": "SELECT 1 AS value", "output": "textfile"}]
+	}`), "test config", configFormatJSON, false)
+	if err == nil {
+		t.Error("parseConfig() of a metric routed to an unconfigured textfile succeeded")
+	}
+}
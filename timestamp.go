@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rowTimestamp converts the value of a metric's timestamp column to a time.
+// Times are taken as they are, numbers as milliseconds since the epoch, and
+// text as either an RFC 3339 time or such a number.
+func rowTimestamp(value interface{}) (time.Time, bool) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, !v.IsZero()
+	case []byte:
+		return rowTimestamp(string(v))
+	case string:
+		v = strings.TrimSpace(v)
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return t, true
+		}
+		ms, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return time.UnixMilli(ms), true
+	}
+
+	ms, ok := toFloat64(value)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(int64(ms)), true
+}
+
+// Sources of the timestamp shared by the series of a scrape
+const (
+	// sharedTimestampScrape stamps the series with the time of the scrape
+	sharedTimestampScrape = "scrape"
+	// sharedTimestampCollection stamps the series with the time of the most
+	// recent collection
+	sharedTimestampCollection = "collection"
+)
+
+// stampSeries gives the series without a timestamp of their own the shared
+// timestamp configured for scrapes, if any, so they present one coherent
+// snapshot. Must be called with metricsMux held.
+func (a *App) stampSeries(series map[string]timeSeries, scraped time.Time) {
+	var stamp time.Time
+	switch a.config.SharedTimestamp {
+	case sharedTimestampScrape:
+		stamp = scraped
+	case sharedTimestampCollection:
+		for _, metric := range a.config.Metrics {
+			if collected := a.stats[metric.Name].collected; collected.After(stamp) {
+				stamp = collected
+			}
+		}
+		// Nothing has been collected in the background yet
+		if stamp.IsZero() {
+			stamp = scraped
+		}
+	default:
+		return
+	}
+
+	for key, s := range series {
+		if s.timestamp.IsZero() {
+			s.timestamp = stamp
+			series[key] = s
+		}
+	}
+}
+
+// formatTimestamp renders a sample timestamp, in milliseconds for the
+// Prometheus text format and in seconds for OpenMetrics
+func formatTimestamp(t time.Time, openMetrics bool) string {
+	ms := t.UnixMilli()
+	if openMetrics {
+		return strconv.FormatFloat(float64(ms)/1000, 'f', -1, 64)
+	}
+	return strconv.FormatInt(ms, 10)
+}
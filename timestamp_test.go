@@ -0,0 +1,178 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRowTimestamp(t *testing.T) {
+	want := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		value  interface{}
+		want   time.Time
+		wantOK bool
+	}{
+		{name: "time", value: want, want: want, wantOK: true},
+		{name: "zero time", value: time.Time{}},
+		{name: "epoch milliseconds", value: int64(1714557600000), want: want, wantOK: true},
+		{name: "float epoch milliseconds", value: float64(1714557600000), want: want, wantOK: true},
+		{name: "RFC 3339", value: []byte("2024-05-01T10:00:00Z"), want: want, wantOK: true},
+		{name: "RFC 3339 with offset", value: "2024-05-01T12:00:00+02:00", want: want, wantOK: true},
+		{name: "milliseconds as text", value: []byte(" 1714557600000 "), want: want, wantOK: true},
+		{name: "invalid text", value: []byte("yesterday")},
+		{name: "null", value: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := rowTimestamp(tt.value)
+			if ok != tt.wantOK || (ok && !got.Equal(tt.want)) {
+				t.Errorf("rowTimestamp(%v) = %v, %t, want %v, %t", tt.value, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestTimestampColumn(t *testing.T) {
+	logs := captureLog(t)
+	app := newTestApp(t, `{
+		"database": {"driver": "mock", "mock": [{
+			"query": "SELECT job, rows_processed AS value, finished_at FROM batch_runs",
+			"columns": ["job", "value", "finished_at"],
+			"rows": [
+				["import", 1520, 1714557600000],
+				["export", 30, "2024-05-01T10:00:01.5Z"],
+				["cleanup", 7, "1714557602000"],
+				["broken", 1, "soon"],
+				["pending", 2, null]
+			]
+		}]},
+		"metrics": [{
+			"name": "batch_rows_processed",
+			"query": "SELECT job, rows_processed AS value, finished_at FROM batch_runs",
+			"timestamp_column": "finished_at"
+		}]
+	}`)
+
+	body := scrape(t, app, "/metrics")
+	wantLines(t, body,
+		`batch_rows_processed{job="import"} 1520 1714557600000`,
+		`batch_rows_processed{job="export"} 30 1714557601500`,
+		`batch_rows_processed{job="cleanup"} 7 1714557602000`,
+	)
+	// The timestamp column isn't a label, and invalid rows are left out
+	for _, unwanted := range []string{"finished_at", `job="broken"`, `job="pending"`} {
+		if strings.Contains(body, unwanted) {
+			t.Errorf("/metrics contains %q:\n%s", unwanted, body)
+		}
+	}
+	for _, want := range []string{
+		`skipping row for metric batch_rows_processed with invalid timestamp "soon"`,
+		`skipping row for metric batch_rows_processed with invalid timestamp "null"`,
+	} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("logs don't contain %q:\n%s", want, logs)
+		}
+	}
+
+	if json := scrape(t, app, "/metrics.json"); !strings.Contains(json, `"timestamp":"2024-05-01T10:00:01.5Z"`) {
+		t.Errorf("/metrics.json doesn't contain the timestamp:\n%s", json)
+	}
+}
+
+func TestSharedTimestamp(t *testing.T) {
+	config := func(mode string) string {
+		return `{
+			"shared_timestamp": "` + mode + `",
+			"database": {"driver": "mock", "mock": [
+				{"query": "SELECT kind, COUNT(*) AS value FROM orders GROUP BY kind", "columns": ["kind", "value"], "rows": [["a", 1], ["b", 2]]},
+				{"query": "SELECT 3 AS value", "columns": ["value"], "rows": [[3]]},
+				{"query": "SELECT 4 AS value, 1714557600000 AS at", "columns": ["value", "at"], "rows": [[4, 1714557600000]]}
+			]},
+			"metrics": [
+				{"name": "orders", "query": "SELECT kind, COUNT(*) AS value FROM orders GROUP BY kind"},
+				{"name": "stock", "query": "SELECT 3 AS value"},
+				{"name": "stamped", "query": "SELECT 4 AS value, 1714557600000 AS at", "timestamp_column": "at"}
+			]
+		}`
+	}
+
+	// stamps returns the timestamps of the query series in a scrape
+	stamps := func(t *testing.T, body string) map[string]string {
+		t.Helper()
+		got := make(map[string]string)
+		for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+			fields := strings.Fields(line)
+			if strings.HasPrefix(line, "#") {
+				continue
+			}
+			if strings.HasPrefix(line, "sqlmetrics_") {
+				if len(fields) != 2 {
+					t.Errorf("exporter metric %q is timestamped", line)
+				}
+				continue
+			}
+			if len(fields) != 3 {
+				t.Errorf("series %q has no timestamp", line)
+				continue
+			}
+			got[fields[0]] = fields[2]
+		}
+		return got
+	}
+
+	t.Run("scrape", func(t *testing.T) {
+		app := newTestApp(t, config("scrape"))
+		before := time.Now().UnixMilli()
+		got := stamps(t, scrape(t, app, "/metrics"))
+		after := time.Now().UnixMilli()
+
+		if got["stamped"] != "1714557600000" {
+			t.Errorf("series with a timestamp column stamped %s, want its own", got["stamped"])
+		}
+		shared := got["stock"]
+		for _, key := range []string{`orders{kind="a"}`, `orders{kind="b"}`} {
+			if got[key] != shared {
+				t.Errorf("%s stamped %s, want the shared %s", key, got[key], shared)
+			}
+		}
+		if ms, err := strconv.ParseInt(shared, 10, 64); err != nil || ms < before || ms > after {
+			t.Errorf("shared timestamp %s, want the scrape's time between %d and %d", shared, before, after)
+		}
+	})
+
+	t.Run("collection", func(t *testing.T) {
+		app := newTestApp(t, config("collection"))
+		var latest time.Time
+		for _, stats := range app.stats {
+			if stats.collected.After(latest) {
+				latest = stats.collected
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+
+		got := stamps(t, scrape(t, app, "/metrics"))
+		want := strconv.FormatInt(latest.UnixMilli(), 10)
+		for _, key := range []string{`orders{kind="a"}`, `orders{kind="b"}`, "stock"} {
+			if got[key] != want {
+				t.Errorf("%s stamped %s, want the latest collection's %s", key, got[key], want)
+			}
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		app := newTestApp(t, strings.Replace(config(""), `"shared_timestamp": "",`, "", 1))
+		wantLines(t, scrape(t, app, "/metrics"),
+			`orders{kind="a"} 1`,
+			"stock 3",
+			"stamped 4 1714557600000",
+		)
+	})
+
+	if _, err := parseConfig(strings.NewReader(`{"shared_timestamp": "now", "database": {"driver": "mock"}}`), "test config", configFormatJSON, false); err == nil {
+		t.Error("parseConfig() with an unsupported shared_timestamp succeeded")
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA is a throwaway certificate authority issuing test certificates
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue signs a certificate for 127.0.0.1, for use by servers or clients,
+// and returns it with its key
+func (ca *testCA) issue(t *testing.T, usage x509.ExtKeyUsage) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// writePEM writes the certificate and its key to PEM files in dir
+func writePEM(t *testing.T, dir string, cert tls.Certificate) (certFile, keyFile string) {
+	t.Helper()
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// startTLSApp starts an app serving with a certificate issued by ca and the
+// rest of the server.tls settings in extra, returning its address
+func startTLSApp(t *testing.T, ca *testCA, extra string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	certFile, keyFile := writePEM(t, dir, ca.issue(t, x509.ExtKeyUsageServerAuth))
+	caFile := filepath.Join(dir, "ca.crt")
+	if err := os.WriteFile(caFile, ca.pem, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	logs := captureLog(t)
+	app := newTestApp(t, fmt.Sprintf(`{
+		"port": 0,
+		"server": {"tls": {"cert_file": %q, "key_file": %q, "client_ca_file": %q%s}},
+		"database": {"driver": "mock", "mock": [{"query": "SELECT 1 AS value", "columns": ["value"], "rows": [[1]]}]},
+		"metrics": [{"name": "up", "query": "SELECT 1 AS value"}]
+	}`, certFile, keyFile, caFile, extra))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() { errCh <- app.Start(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-errCh
+	})
+
+	_, port, err := net.SplitHostPort(waitForLog(t, logs, "Starting server on "))
+	if err != nil {
+		t.Fatalf("error parsing the listen address: %v", err)
+	}
+	return "127.0.0.1:" + port
+}
+
+// tlsGet GETs /metrics from addr over TLS, trusting ca and presenting certs
+func tlsGet(addr string, ca *testCA, tlsConfig *tls.Config) (*http.Response, error) {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	tlsConfig.RootCAs = roots
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	resp, err := client.Get("https://" + addr + "/metrics")
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+func TestServeTLS(t *testing.T) {
+	ca := newTestCA(t)
+	addr := startTLSApp(t, ca, "")
+
+	resp, err := tlsGet(addr, ca, &tls.Config{})
+	if err != nil {
+		t.Fatalf("GET over TLS error = %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET over TLS status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	// The server answers plain HTTP with a 400 rather than the metrics
+	if resp, err := http.Get("http://" + addr + "/metrics"); err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("GET over plain HTTP status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+
+	// Certificates presented without being required must still be valid
+	other := newTestCA(t)
+	if _, err := tlsGet(addr, ca, &tls.Config{Certificates: []tls.Certificate{other.issue(t, x509.ExtKeyUsageClientAuth)}}); err == nil {
+		t.Error("GET with a client certificate from another CA succeeded, want it rejected")
+	}
+}
+
+func TestServeMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	addr := startTLSApp(t, ca, `, "require_client_cert": true`)
+
+	tests := []struct {
+		name   string
+		certs  []tls.Certificate
+		wantOK bool
+	}{
+		{name: "no certificate"},
+		{name: "other CA", certs: []tls.Certificate{newTestCA(t).issue(t, x509.ExtKeyUsageClientAuth)}},
+		{name: "valid certificate", certs: []tls.Certificate{ca.issue(t, x509.ExtKeyUsageClientAuth)}, wantOK: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := tlsGet(addr, ca, &tls.Config{Certificates: tt.certs})
+			if !tt.wantOK {
+				if err == nil {
+					t.Errorf("GET status = %d, want the handshake rejected", resp.StatusCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GET error = %v", err)
+			}
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("GET status = %d, want %d", resp.StatusCode, http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestServeTLSMinVersion(t *testing.T) {
+	ca := newTestCA(t)
+	addr := startTLSApp(t, ca, `, "min_version": "1.3"`)
+
+	if _, err := tlsGet(addr, ca, &tls.Config{MaxVersion: tls.VersionTLS12}); err == nil {
+		t.Error("GET over TLS 1.2 succeeded, want it rejected below min_version 1.3")
+	}
+	resp, err := tlsGet(addr, ca, &tls.Config{MinVersion: tls.VersionTLS13})
+	if err != nil {
+		t.Fatalf("GET over TLS 1.3 error = %v", err)
+	}
+	if resp.TLS.Version != tls.VersionTLS13 {
+		t.Errorf("negotiated TLS version %x, want 1.3", resp.TLS.Version)
+	}
+}
+
+func TestServerTLSConfigErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   string
+	}{
+		{
+			name:   "unsupported version",
+			config: `{"database": {"driver": "mock"}, "server": {"tls": {"cert_file": "a.crt", "key_file": "a.key", "min_version": "1.4"}}}`,
+			want:   `server.tls.min_version "1.4" is unsupported`,
+		},
+		{
+			name:   "cert without key",
+			config: `{"database": {"driver": "mock"}, "server": {"tls": {"cert_file": "a.crt"}}}`,
+			want:   "server.tls.cert_file and server.tls.key_file must be set together",
+		},
+		{
+			name:   "client CA without TLS",
+			config: `{"database": {"driver": "mock"}, "server": {"tls": {"client_ca_file": "ca.crt"}}}`,
+			want:   "server.tls.client_ca_file needs TLS",
+		},
+		{
+			name:   "required client cert without CA",
+			config: `{"database": {"driver": "mock"}, "server": {"tls": {"cert_file": "a.crt", "key_file": "a.key", "require_client_cert": true}}}`,
+			want:   "server.tls.require_client_cert needs a server.tls.client_ca_file",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseConfig(strings.NewReader(tt.config), "test config", configFormatJSON, false)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("parseConfig() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import "encoding/json"
+
+// ValueColumnConfig describes one of a metric's value columns and the metric
+// it is exposed as, named <metric_name>_<column>
+type ValueColumnConfig struct {
+	Column string `json:"column"`
+	// Help, Type and Unit override the metric's for this column. Type may
+	// be gauge or counter.
+	Help string `json:"help"`
+	Type string `json:"type"`
+	Unit string `json:"unit"`
+}
+
+// UnmarshalJSON accepts a value column given by just its name, as well as a
+// full description
+func (c *ValueColumnConfig) UnmarshalJSON(data []byte) error {
+	var column string
+	if err := json.Unmarshal(data, &column); err == nil {
+		*c = ValueColumnConfig{Column: column}
+		return nil
+	}
+
+	type plain ValueColumnConfig
+	return json.Unmarshal(data, (*plain)(c))
+}
+
+// valueColumn returns the value column that series named name are exposed
+// from, if any
+func (m MetricConfig) valueColumn(name string) (ValueColumnConfig, bool) {
+	for _, col := range m.ValueColumns {
+		if m.MetricName+"_"+col.Column == name {
+			return col, true
+		}
+	}
+	return ValueColumnConfig{}, false
+}
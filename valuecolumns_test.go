@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValueColumns(t *testing.T) {
+	app := newTestApp(t, `{
+		"database": {"driver": "mock", "mock": [
+			{"query": "SELECT region, min, max, avg FROM orders", "columns": ["region", "min", "max", "avg"], "rows": [["eu", 3, 310, 42.5], ["us", 1, 90, 20]]},
+			{"query": "SELECT queue, depth, processed_total FROM queue_stats", "columns": ["queue", "depth", "processed_total"], "rows": [["jobs", 7, 100]]}
+		]},
+		"metrics": [
+			{"name": "order_amount", "query": "SELECT region, min, max, avg FROM orders", "value_columns": ["min", "max", "avg"]},
+			{"name": "queue", "query": "SELECT queue, depth, processed_total FROM queue_stats", "value_columns": [
+				"depth",
+				{"column": "processed_total", "help": "Jobs processed since the queue was created", "type": "counter"}
+			]}
+		]
+	}`)
+
+	body := scrape(t, app, "/metrics")
+	wantLines(t, body,
+		`order_amount_min{region="eu"} 3`,
+		`order_amount_max{region="eu"} 310`,
+		`order_amount_avg{region="eu"} 42.5`,
+		`order_amount_min{region="us"} 1`,
+		"# TYPE order_amount_avg gauge",
+		"# TYPE queue_depth gauge",
+		`queue_depth{queue="jobs"} 7`,
+		"# HELP queue_processed_total Jobs processed since the queue was created",
+		"# TYPE queue_processed_total counter",
+		`queue_processed_total{queue="jobs"} 100`,
+	)
+	// Value columns don't become labels, and there is no plain series
+	if strings.Contains(body, "min=") || strings.Contains(body, "\norder_amount{") {
+		t.Errorf("/metrics has value columns as labels or a plain series:\n%s", body)
+	}
+
+	// A missing value column fails the query
+	app = newTestApp(t, `{
+		"database": {"driver": "mock", "mock": [{"query": "SELECT region, min FROM orders", "columns": ["region", "min"], "rows": [["eu", 3]]}]},
+		"metrics": [{"name": "order_amount", "query": "SELECT region, min FROM orders", "value_columns": ["min", "max"], "on_scrape": true}]
+	}`)
+	err := app.runQuery(context.Background(), app.config.Metrics[0])
+	if err == nil || !strings.Contains(err.Error(), "query must include the value column 'max'") {
+		t.Errorf("runQuery() error = %v, want the missing value column", err)
+	}
+
+	_, err = parseConfig(strings.NewReader(`{
+		"database": {"driver": "mock"},
+		"metrics": [{"name": "m", "query": "SELECT 1", "value_columns": [{"column": "a", "type": "histogram"}]}]
+	}`), "test config", configFormatJSON, false)
+	want := `metric m has value column "a" of unsupported type "histogram"`
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("parseConfig() error = %v, want %q", err, want)
+	}
+}
+
+func TestValueColumnMetadata(t *testing.T) {
+	logs := captureLog(t)
+	app := newTestApp(t, `{
+		"database": {"driver": "mock", "mock": [{
+			"query": "SELECT queue, depth, processed_total, oldest_age_seconds, wait FROM queue_stats",
+			"columns": ["queue", "depth", "processed_total", "oldest_age_seconds", "wait"],
+			"rows": [["jobs", 7, 100, 1.5, 2], ["mail", 0, 12, 0, 0]]
+		}]},
+		"metrics": [{
+			"name": "queue",
+			"query": "SELECT queue, depth, processed_total, oldest_age_seconds, wait FROM queue_stats",
+			"value_columns": [
+				{"column": "depth", "help": "Jobs waiting in the queue"},
+				{"column": "processed_total", "help": "Jobs processed since the queue was created", "type": "counter"},
+				{"column": "oldest_age_seconds", "help": "Age of the oldest waiting job", "unit": "seconds"},
+				{"column": "wait", "unit": "seconds"}
+			]
+		}]
+	}`)
+	if !strings.Contains(logs.String(), `ignoring unit "seconds" of metric queue_wait,`) {
+		t.Errorf("unit not matching the column's name wasn't warned about:\n%s", logs)
+	}
+
+	// Every column is its own family, sharing the row's labels
+	wantLines(t, scrape(t, app, "/metrics"),
+		"# HELP queue_depth Jobs waiting in the queue",
+		"# TYPE queue_depth gauge",
+		`queue_depth{queue="jobs"} 7`,
+		`queue_depth{queue="mail"} 0`,
+		"# HELP queue_processed_total Jobs processed since the queue was created",
+		"# TYPE queue_processed_total counter",
+		`queue_processed_total{queue="jobs"} 100`,
+		`queue_processed_total{queue="mail"} 12`,
+		"# HELP queue_oldest_age_seconds Age of the oldest waiting job",
+		"# TYPE queue_oldest_age_seconds gauge",
+		`queue_oldest_age_seconds{queue="jobs"} 1.5`,
+		"# TYPE queue_wait gauge",
+		`queue_wait{queue="jobs"} 2`,
+	)
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	rec := httptest.NewRecorder()
+	app.routes().ServeHTTP(rec, req)
+	body := rec.Body.String()
+	wantLines(t, body,
+		"# TYPE queue_processed counter",
+		"# UNIT queue_oldest_age_seconds seconds",
+	)
+	for _, unwanted := range []string{"# UNIT queue_depth ", "# UNIT queue_processed ", "# UNIT queue_wait "} {
+		if strings.Contains(body, unwanted) {
+			t.Errorf("OpenMetrics exposition contains %q:\n%s", unwanted, body)
+		}
+	}
+}
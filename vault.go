@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// VaultConfig holds the configuration for fetching dynamic database
+// credentials from HashiCorp Vault's database secrets engine
+type VaultConfig struct {
+	// Address of the Vault server, e.g. https://vault:8200
+	Address string `json:"address"`
+	// Token used to authenticate to Vault
+	Token string `json:"token"`
+	// SecretPath is the credentials endpoint, e.g. database/creds/readonly.
+	// Vault is only used when this is set.
+	SecretPath string `json:"secret_path"`
+	// DSNTemplate is the DSN with {{username}} and {{password}} placeholders
+	// for the issued credentials
+	DSNTemplate string `json:"dsn_template"`
+}
+
+// vaultRetryDelay is how long to wait before retrying a failed credential fetch
+const vaultRetryDelay = 10 * time.Second
+
+// vaultLease is a set of dynamic credentials and the lease they were issued under
+type vaultLease struct {
+	id        string
+	duration  time.Duration
+	renewable bool
+	username  string
+	password  string
+}
+
+// dsn fills the credentials into a DSN template
+func (l *vaultLease) dsn(template string) string {
+	return strings.NewReplacer(
+		"{{username}}", l.username,
+		"{{password}}", l.password,
+	).Replace(template)
+}
+
+// vaultClient is a minimal client for the Vault HTTP API
+type vaultClient struct {
+	config VaultConfig
+	client *http.Client
+}
+
+// newVaultClient creates a client for the configured Vault server
+func newVaultClient(config VaultConfig) *vaultClient {
+	return &vaultClient{
+		config: config,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// readCredentials fetches a new set of database credentials
+func (c *vaultClient) readCredentials(ctx context.Context) (*vaultLease, error) {
+	var response struct {
+		LeaseID       string `json:"lease_id"`
+		LeaseDuration int    `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+		Data          struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		} `json:"data"`
+	}
+
+	if err := c.do(ctx, http.MethodGet, c.config.SecretPath, nil, &response); err != nil {
+		return nil, err
+	}
+
+	return &vaultLease{
+		id:        response.LeaseID,
+		duration:  time.Duration(response.LeaseDuration) * time.Second,
+		renewable: response.Renewable,
+		username:  response.Data.Username,
+		password:  response.Data.Password,
+	}, nil
+}
+
+// renewLease extends a lease by increment, returning the lease's new duration.
+// Vault may grant less than requested as the lease nears its maximum TTL.
+func (c *vaultClient) renewLease(ctx context.Context, leaseID string, increment time.Duration) (time.Duration, error) {
+	request := map[string]interface{}{
+		"lease_id":  leaseID,
+		"increment": int(increment.Seconds()),
+	}
+
+	var response struct {
+		LeaseDuration int `json:"lease_duration"`
+	}
+	if err := c.do(ctx, http.MethodPut, "sys/leases/renew", request, &response); err != nil {
+		return 0, err
+	}
+	return time.Duration(response.LeaseDuration) * time.Second, nil
+}
+
+// do sends a request to the Vault API and decodes the JSON response
+func (c *vaultClient) do(ctx context.Context, method, path string, request, response interface{}) error {
+	var body io.Reader
+	if request != nil {
+		data, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	url := strings.TrimRight(c.config.Address, "/") + "/v1/" + strings.TrimLeft(path, "/")
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", c.config.Token)
+	if request != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("vault returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+// maintainVaultLease keeps the database credentials valid, renewing the lease
+// before it expires and rotating to new credentials (recreating the
+// connection pools) once it can no longer be renewed
+func (a *App) maintainVaultLease(ctx context.Context) {
+	lease := a.vaultLease
+	for {
+		if lease.duration <= 0 {
+			// Credentials without a lease never expire
+			return
+		}
+
+		// Act with a third of the lease still remaining
+		timer := time.NewTimer(lease.duration * 2 / 3)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+
+		if lease.renewable {
+			duration, err := a.vault.renewLease(ctx, lease.id, lease.duration)
+			if err == nil && duration >= lease.duration {
+				log.Printf("Renewed vault lease for database credentials")
+				continue
+			}
+			if err != nil {
+				log.Printf("Error renewing vault lease, rotating credentials: %v", err)
+			} else {
+				log.Printf("Vault lease is nearing its maximum TTL, rotating credentials")
+			}
+		}
+
+		newLease, err := a.rotateVaultCredentials(ctx)
+		for err != nil {
+			log.Printf("Error rotating vault credentials: %v", err)
+			select {
+			case <-time.After(vaultRetryDelay):
+			case <-ctx.Done():
+				return
+			}
+			newLease, err = a.rotateVaultCredentials(ctx)
+		}
+		lease = newLease
+	}
+}
+
+// rotateVaultCredentials fetches new credentials and recreates the
+// connection pools with them
+func (a *App) rotateVaultCredentials(ctx context.Context) (*vaultLease, error) {
+	lease, err := a.vault.readCredentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// A reload running meanwhile would carry the replaced credentials over
+	// into its pools
+	a.collectorMux.Lock()
+	defer a.collectorMux.Unlock()
+
+	a.metricsMux.RLock()
+	dbConfig := a.config.Database
+	a.metricsMux.RUnlock()
+
+	dbConfig.DSN = lease.dsn(a.config.Vault.DSNTemplate)
+	if err := a.replaceDBs(dbConfig, a.metricConfigs()); err != nil {
+		return nil, err
+	}
+
+	// Keep the issued credentials across config reloads
+	a.metricsMux.Lock()
+	a.config.Database.DSN = dbConfig.DSN
+	a.metricsMux.Unlock()
+
+	log.Printf("Rotated database credentials from vault")
+	return lease, nil
+}
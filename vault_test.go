@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// mockVault is a Vault server issuing numbered credentials and renewing
+// leases by the durations in renewals, in turn
+type mockVault struct {
+	issued   atomic.Int32
+	renewed  atomic.Int32
+	duration int
+	renewals []int
+}
+
+func (v *mockVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Vault-Token") != "root" {
+		http.Error(w, "permission denied", http.StatusForbidden)
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/v1/database/creds/ro":
+		n := v.issued.Add(1)
+		fmt.Fprintf(w, `{"lease_id": "database/creds/ro/%d", "lease_duration": %d, "renewable": %v, "data": {"username": "u%d", "password": "p%d"}}`,
+			n, v.duration, len(v.renewals) > 0, n, n)
+	case r.Method == http.MethodPut && r.URL.Path == "/v1/sys/leases/renew":
+		var request struct {
+			LeaseID string `json:"lease_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.LeaseID == "" {
+			http.Error(w, "missing lease_id", http.StatusBadRequest)
+			return
+		}
+		n := int(v.renewed.Add(1)) - 1
+		if n >= len(v.renewals) {
+			n = len(v.renewals) - 1
+		}
+		fmt.Fprintf(w, `{"lease_id": %q, "lease_duration": %d}`, request.LeaseID, v.renewals[n])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// newVaultApp creates an App on the mock driver whose credentials come from
+// the Vault server at address
+func newVaultApp(t *testing.T, address string) *App {
+	t.Helper()
+	return newTestApp(t, fmt.Sprintf(`{
+		"database": {"driver": "mock"},
+		"vault": {"address": %q, "token": "root", "secret_path": "database/creds/ro", "dsn_template": "{{username}}:{{password}}@tcp(db)/app"},
+		"metrics": []
+	}`, address))
+}
+
+func TestVaultClient(t *testing.T) {
+	vault := &mockVault{duration: 60, renewals: []int{45}}
+	server := httptest.NewServer(vault)
+	defer server.Close()
+
+	client := newVaultClient(VaultConfig{Address: server.URL + "/", Token: "root", SecretPath: "database/creds/ro"})
+	lease, err := client.readCredentials(context.Background())
+	if err != nil {
+		t.Fatalf("readCredentials() error = %v", err)
+	}
+	want := vaultLease{id: "database/creds/ro/1", duration: time.Minute, renewable: true, username: "u1", password: "p1"}
+	if *lease != want {
+		t.Errorf("readCredentials() = %+v, want %+v", *lease, want)
+	}
+	if dsn := lease.dsn("{{username}}:{{password}}@tcp(db)/app"); dsn != "u1:p1@tcp(db)/app" {
+		t.Errorf("dsn() = %q, want %q", dsn, "u1:p1@tcp(db)/app")
+	}
+
+	duration, err := client.renewLease(context.Background(), lease.id, lease.duration)
+	if err != nil {
+		t.Fatalf("renewLease() error = %v", err)
+	}
+	if duration != 45*time.Second {
+		t.Errorf("renewLease() = %s, want 45s", duration)
+	}
+
+	client.config.Token = "wrong"
+	if _, err := client.readCredentials(context.Background()); err == nil {
+		t.Error("readCredentials() with a wrong token error = nil, want an error")
+	}
+}
+
+func TestVaultLeaseRenewalAndRotation(t *testing.T) {
+	// The lease is renewed once in full, then only partially, which means
+	// it is nearing its maximum TTL and the credentials must be rotated
+	vault := &mockVault{duration: 1, renewals: []int{1, 0}}
+	server := httptest.NewServer(vault)
+	defer server.Close()
+
+	app := newVaultApp(t, server.URL)
+	if dsn := app.config.Database.DSN; dsn != "u1:p1@tcp(db)/app" {
+		t.Fatalf("DSN = %q, want the issued credentials", dsn)
+	}
+	oldDB := app.sharedDB()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.maintainVaultLease(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for vault.issued.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+
+	if n := vault.renewed.Load(); n != 2 {
+		t.Errorf("lease was renewed %d times, want 2", n)
+	}
+	if n := vault.issued.Load(); n != 2 {
+		t.Fatalf("credentials were issued %d times, want 2", n)
+	}
+	// The pools are swapped right after the credentials are issued
+	for app.sharedDB() == oldDB && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	app.metricsMux.RLock()
+	dsn := app.config.Database.DSN
+	app.metricsMux.RUnlock()
+	if dsn != "u2:p2@tcp(db)/app" {
+		t.Errorf("DSN after rotation = %q, want the rotated credentials", dsn)
+	}
+}
+
+func TestVaultRotationDuringReload(t *testing.T) {
+	server := httptest.NewServer(&mockVault{duration: 3600})
+	defer server.Close()
+	app := newVaultApp(t, server.URL)
+
+	var wg sync.WaitGroup
+	var last atomic.Value
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			lease, err := app.rotateVaultCredentials(context.Background())
+			if err != nil {
+				t.Errorf("rotateVaultCredentials() error = %v", err)
+				return
+			}
+			last.Store(lease.dsn(app.config.Vault.DSNTemplate))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			app.metricsMux.RLock()
+			config := app.config
+			app.metricsMux.RUnlock()
+			// A changed pool size makes the reload recreate the pools
+			config.Database.MaxOpen = i + 1
+			if err := app.Reload(config); err != nil {
+				t.Errorf("Reload() error = %v", err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	// A reload never brings back revoked credentials
+	app.metricsMux.RLock()
+	dsn := app.config.Database.DSN
+	app.metricsMux.RUnlock()
+	if want := last.Load(); dsn != want {
+		t.Errorf("DSN = %q, want the last rotated %q", dsn, want)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// WebhookConfig holds the configuration for notifying a webhook of failed
+// collections, for alerting that doesn't wait for Prometheus
+type WebhookConfig struct {
+	// URL the notifications are POSTed to. Notifying is disabled when empty,
+	// unless a metric sets its own URL.
+	URL string `json:"url"`
+	// MinInterval is the least time between notifications about the same
+	// metric, so a metric failing on every collection can't flood the webhook
+	MinInterval time.Duration `json:"min_interval"`
+}
+
+// failureNotification is the JSON body POSTed to the failure webhook
+type failureNotification struct {
+	Metric   string    `json:"metric"`
+	Error    string    `json:"error"`
+	Failures int       `json:"consecutive_failures"`
+	Time     time.Time `json:"time"`
+}
+
+// webhookClient sends the webhook notifications
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// notifyFailure POSTs a failed collection of the metric to its failure
+// webhook, at most once per MinInterval for each metric. The notification is
+// sent in the background so a slow webhook can't hold up collection.
+func (a *App) notifyFailure(metric MetricConfig, collectErr error) {
+	url := metric.FailureWebhookURL
+	if url == "" {
+		url = a.config.FailureWebhook.URL
+	}
+	if url == "" {
+		return
+	}
+
+	a.metricsMux.Lock()
+	stats := a.stats[metric.Name]
+	if !stats.notified.IsZero() && time.Since(stats.notified) < a.config.FailureWebhook.MinInterval {
+		a.metricsMux.Unlock()
+		return
+	}
+	stats.notified = time.Now()
+	notification := failureNotification{
+		Metric:   metric.Name,
+		Error:    collectErr.Error(),
+		Failures: stats.failures,
+		Time:     stats.notified,
+	}
+	a.metricsMux.Unlock()
+
+	go func() {
+		if err := postWebhook(url, notification); err != nil {
+			log.Printf("Error notifying failure webhook of metric %s: %v", metric.Name, err)
+		}
+	}()
+}
+
+// postWebhook POSTs v as JSON to url
+func postWebhook(url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("webhook returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// webhookReceiver starts a webhook server sending each notification it
+// receives on the returned channel
+func webhookReceiver(t *testing.T) (*httptest.Server, chan failureNotification) {
+	t.Helper()
+
+	received := make(chan failureNotification, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var notification failureNotification
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("webhook got %s with content type %q, want a JSON POST", r.Method, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&notification); err != nil {
+			t.Errorf("error decoding notification: %v", err)
+		}
+		received <- notification
+	}))
+	t.Cleanup(server.Close)
+	return server, received
+}
+
+func TestFailureWebhook(t *testing.T) {
+	global, globalReceived := webhookReceiver(t)
+	critical, criticalReceived := webhookReceiver(t)
+
+	captureLog(t)
+	app := newTestApp(t, `{
+		"database": {"driver": "mock", "mock": [
+			{"query": "SELECT 1 AS value", "columns": ["value"], "rows": [[1]]},
+			{"query": "SELECT value FROM broken", "error": "table broken doesn't exist"}
+		]},
+		"failure_webhook": {"url": "`+global.URL+`", "min_interval": "1h"},
+		"metrics": [
+			{"name": "up", "query": "SELECT 1 AS value", "on_scrape": true},
+			{"name": "broken", "query": "SELECT value FROM broken", "on_scrape": true},
+			{"name": "critical", "query": "SELECT value FROM broken", "on_scrape": true, "failure_webhook_url": "`+critical.URL+`"}
+		]
+	}`)
+	up, broken, criticalMetric := app.config.Metrics[0], app.config.Metrics[1], app.config.Metrics[2]
+
+	// receive returns the next notification, failing the test without one
+	receive := func(received chan failureNotification) failureNotification {
+		t.Helper()
+		select {
+		case notification := <-received:
+			return notification
+		case <-time.After(5 * time.Second):
+			t.Fatal("no notification received")
+			return failureNotification{}
+		}
+	}
+	// expectNone fails the test if a notification arrives soon
+	expectNone := func(received chan failureNotification) {
+		t.Helper()
+		select {
+		case notification := <-received:
+			t.Errorf("unexpected notification %+v", notification)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	app.collect(context.Background(), up)
+	expectNone(globalReceived)
+
+	app.collect(context.Background(), broken)
+	got := receive(globalReceived)
+	if got.Metric != "broken" || got.Error != "error executing query: table broken doesn't exist" || got.Failures != 1 || got.Time.IsZero() {
+		t.Errorf("notification = %+v, want the first failure of broken", got)
+	}
+
+	// Further failures within min_interval aren't sent
+	app.collect(context.Background(), broken)
+	expectNone(globalReceived)
+
+	app.metricsMux.Lock()
+	app.stats[broken.Name].notified = time.Now().Add(-2 * time.Hour)
+	app.metricsMux.Unlock()
+	app.collect(context.Background(), broken)
+	if got := receive(globalReceived); got.Failures != 3 {
+		t.Errorf("notification after min_interval = %+v, want 3 consecutive failures", got)
+	}
+
+	// A metric's own webhook replaces the global one
+	app.collect(context.Background(), criticalMetric)
+	if got := receive(criticalReceived); got.Metric != "critical" {
+		t.Errorf("notification = %+v, want critical's failure", got)
+	}
+	expectNone(globalReceived)
+}